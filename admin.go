@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// advertisementStatus holds the result of the last verification of the
+// service path advertisement toward the bgp peers
+type advertisementStatus struct {
+	Prefix     string          `json:"prefix"`
+	Advertised bool            `json:"advertised"`
+	LocalRib   bool            `json:"localRib"`
+	Peers      map[string]bool `json:"peers"`
+}
+
+var (
+	advertisementMu sync.Mutex
+	advertisement   = advertisementStatus{Peers: map[string]bool{}}
+)
+
+// verifyAdvertisement checks that the advertised service path has been sent to
+// all the established peers, and logs an error for each peer that has not
+// received it
+func verifyAdvertisement(adv advertiser, config *config, advertised bool) {
+	prefix := config.Service.IP
+	prefixLen := fmt.Sprint(config.Service.PrefixLength)
+	nextHop := config.Bgp.Local.RouterId
+	local, peers, err := adv.V4PathAdvertisements(config.Service.IP, config.Service.PrefixLength)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Warn("Cannot verify path advertisement")
+		return
+	}
+
+	advertisementMu.Lock()
+	defer advertisementMu.Unlock()
+	for peer, sent := range peers {
+		// Only alert when the peer status changes, to avoid repeating the
+		// same error on every check
+		prev, known := advertisement.Peers[peer]
+		if local && !sent && (!known || prev || !advertisement.LocalRib) {
+			log.WithFields(log.Fields{
+				"peer":   peer,
+				"prefix": fmt.Sprintf("%s/%s", prefix, prefixLen),
+			}).Error("Path is in the local rib but was not sent to an established peer")
+		}
+		setBGPPathPeerAdvertisementMetric(prefix, prefixLen, nextHop, peer, sent)
+	}
+	for peer := range advertisement.Peers {
+		if _, ok := peers[peer]; !ok {
+			setBGPPathPeerAdvertisementMetric(prefix, prefixLen, nextHop, peer, false)
+		}
+	}
+	advertisement.Prefix = fmt.Sprintf("%s/%s", prefix, prefixLen)
+	advertisement.Advertised = advertised
+	advertisement.LocalRib = local
+	advertisement.Peers = peers
+}
+
+// advertisementHandler serves the last advertisement verification result
+func advertisementHandler(w http.ResponseWriter, _ *http.Request) {
+	advertisementMu.Lock()
+	status := advertisement
+	status.Peers = maps.Clone(advertisement.Peers)
+	advertisementMu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Warn("Cannot encode advertisement status")
+	}
+}
+
+// registerAdminHandlers adds the admin api endpoints to the server that also
+// serves the metrics
+func registerAdminHandlers() {
+	http.HandleFunc("/advertisement", advertisementHandler)
+}
@@ -0,0 +1,550 @@
+// Single-hop BFD asynchronous mode implementation based on
+// https://www.rfc-editor.org/rfc/rfc5880 and
+// https://www.rfc-editor.org/rfc/rfc5881
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	bfdPort            = 3784
+	bfdVersion         = 1
+	bfdPacketLength    = 24
+	bfdTTL             = 255         // single-hop sessions are sent and expected with the max TTL (GTSM)
+	bfdSlowTxInterval  = time.Second // the minimum transmit interval while a session is not up
+	bfdSourcePortMin   = 49152
+	bfdSourcePortMax   = 65535
+	bfdReceiveBufferSz = 1500
+)
+
+// bfdState is the state of a bfd session as described in RFC 5880 section 4.1
+type bfdState uint8
+
+const (
+	bfdStateAdminDown bfdState = iota
+	bfdStateDown
+	bfdStateInit
+	bfdStateUp
+)
+
+func (s bfdState) String() string {
+	switch s {
+	case bfdStateAdminDown:
+		return "AdminDown"
+	case bfdStateDown:
+		return "Down"
+	case bfdStateInit:
+		return "Init"
+	case bfdStateUp:
+		return "Up"
+	}
+	return fmt.Sprintf("Unknown(%d)", uint8(s))
+}
+
+// bfdDiag is the diagnostic code that explains the reason of the last session
+// state change
+type bfdDiag uint8
+
+const (
+	bfdDiagNone                    bfdDiag = 0
+	bfdDiagControlDetectionExpired bfdDiag = 1
+	bfdDiagNeighborDown            bfdDiag = 3
+	bfdDiagAdminDown               bfdDiag = 7
+)
+
+func (d bfdDiag) String() string {
+	switch d {
+	case bfdDiagNone:
+		return "No Diagnostic"
+	case bfdDiagControlDetectionExpired:
+		return "Control Detection Time Expired"
+	case bfdDiagNeighborDown:
+		return "Neighbor Signaled Session Down"
+	case bfdDiagAdminDown:
+		return "Administratively Down"
+	}
+	return fmt.Sprintf("Unknown(%d)", uint8(d))
+}
+
+// bfdPacket is a bfd control packet without authentication
+type bfdPacket struct {
+	Diag              bfdDiag
+	State             bfdState
+	Poll              bool
+	Final             bool
+	DetectMult        uint8
+	MyDiscriminator   uint32
+	YourDiscriminator uint32
+	DesiredMinTx      time.Duration
+	RequiredMinRx     time.Duration
+	RequiredMinEchoRx time.Duration
+}
+
+func (p *bfdPacket) marshal() []byte {
+	b := make([]byte, bfdPacketLength)
+	b[0] = bfdVersion<<5 | uint8(p.Diag)&0x1f
+	b[1] = uint8(p.State) << 6
+	if p.Poll {
+		b[1] |= 0x20
+	}
+	if p.Final {
+		b[1] |= 0x10
+	}
+	b[2] = p.DetectMult
+	b[3] = bfdPacketLength
+	binary.BigEndian.PutUint32(b[4:], p.MyDiscriminator)
+	binary.BigEndian.PutUint32(b[8:], p.YourDiscriminator)
+	binary.BigEndian.PutUint32(b[12:], uint32(p.DesiredMinTx.Microseconds()))
+	binary.BigEndian.PutUint32(b[16:], uint32(p.RequiredMinRx.Microseconds()))
+	binary.BigEndian.PutUint32(b[20:], uint32(p.RequiredMinEchoRx.Microseconds()))
+	return b
+}
+
+// unmarshalBFDPacket parses a bfd control packet and applies the validation
+// checks of RFC 5880 section 6.8.6 that do not depend on session state
+func unmarshalBFDPacket(b []byte) (*bfdPacket, error) {
+	if len(b) < bfdPacketLength {
+		return nil, fmt.Errorf("packet too short: %d bytes", len(b))
+	}
+	if v := b[0] >> 5; v != bfdVersion {
+		return nil, fmt.Errorf("unsupported version: %d", v)
+	}
+	length := int(b[3])
+	if length < bfdPacketLength || length > len(b) {
+		return nil, fmt.Errorf("invalid length field: %d", length)
+	}
+	if b[1]&0x04 != 0 {
+		return nil, errors.New("authentication is not supported")
+	}
+	if b[1]&0x01 != 0 {
+		return nil, errors.New("multipoint bit is set")
+	}
+	p := &bfdPacket{
+		Diag:              bfdDiag(b[0] & 0x1f),
+		State:             bfdState(b[1] >> 6),
+		Poll:              b[1]&0x20 != 0,
+		Final:             b[1]&0x10 != 0,
+		DetectMult:        b[2],
+		MyDiscriminator:   binary.BigEndian.Uint32(b[4:]),
+		YourDiscriminator: binary.BigEndian.Uint32(b[8:]),
+		DesiredMinTx:      time.Duration(binary.BigEndian.Uint32(b[12:])) * time.Microsecond,
+		RequiredMinRx:     time.Duration(binary.BigEndian.Uint32(b[16:])) * time.Microsecond,
+		RequiredMinEchoRx: time.Duration(binary.BigEndian.Uint32(b[20:])) * time.Microsecond,
+	}
+	if p.DetectMult == 0 {
+		return nil, errors.New("detect multiplier is zero")
+	}
+	if p.MyDiscriminator == 0 {
+		return nil, errors.New("my discriminator is zero")
+	}
+	if p.YourDiscriminator == 0 && p.State != bfdStateDown && p.State != bfdStateAdminDown {
+		return nil, fmt.Errorf("your discriminator is zero in state %s", p.State)
+	}
+	if p.Poll && p.Final {
+		return nil, errors.New("both poll and final bits are set")
+	}
+	return p, nil
+}
+
+// bfdSessionConfig contains the timers of a bfd session
+type bfdSessionConfig struct {
+	DesiredMinTx  time.Duration
+	RequiredMinRx time.Duration
+	DetectMult    uint8
+}
+
+// bfdSession is a single-hop bfd session toward a peer. All the session state
+// is owned by the run loop goroutine, apart from the current state that can be
+// read via State().
+type bfdSession struct {
+	peer          net.IP
+	config        bfdSessionConfig
+	conn          *net.UDPConn
+	rx            chan *bfdPacket
+	onStateChange func(old, new bfdState, diag bfdDiag, remoteAdminDown bool)
+
+	state               atomic.Uint32
+	diag                bfdDiag
+	localDiscriminator  uint32
+	remoteDiscriminator uint32
+	remoteState         bfdState
+	remoteDesiredMinTx  time.Duration
+	remoteRequiredMinRx time.Duration
+	remoteDetectMult    uint8
+	pollPending         bool
+}
+
+// State returns the current state of the session
+func (s *bfdSession) State() bfdState {
+	return bfdState(s.state.Load())
+}
+
+func (s *bfdSession) setState(state bfdState, diag bfdDiag) {
+	s.changeState(state, diag, false)
+}
+
+// changeState sets the state of the session, also telling the state change
+// callback whether the peer brought the session down administratively, which
+// must not be taken as a forwarding failure (RFC 5882 section 3.2)
+func (s *bfdSession) changeState(state bfdState, diag bfdDiag, remoteAdminDown bool) {
+	old := s.State()
+	if old == state {
+		return
+	}
+	s.state.Store(uint32(state))
+	s.diag = diag
+	// The slower transmit interval used before the session comes up is
+	// lowered via a poll sequence to inform the peer
+	s.pollPending = state == bfdStateUp && s.config.DesiredMinTx < bfdSlowTxInterval
+	if state == bfdStateDown {
+		s.remoteDiscriminator = 0
+	}
+	log.WithFields(log.Fields{
+		"peer":      s.peer.String(),
+		"old_state": old.String(),
+		"new_state": state.String(),
+		"diag":      diag.String(),
+	}).Info("BFD session state changed")
+	if s.onStateChange != nil {
+		s.onStateChange(old, state, diag, remoteAdminDown)
+	}
+}
+
+// desiredMinTx returns the transmit interval the session advertises
+func (s *bfdSession) desiredMinTx() time.Duration {
+	if s.State() != bfdStateUp && s.config.DesiredMinTx < bfdSlowTxInterval {
+		return bfdSlowTxInterval
+	}
+	return s.config.DesiredMinTx
+}
+
+// txInterval returns the jittered interval until the next periodic packet as
+// described in RFC 5880 section 6.8.7
+func (s *bfdSession) txInterval() time.Duration {
+	interval := max(s.desiredMinTx(), s.remoteRequiredMinRx)
+	reduction := rand.IntN(26) // 0-25%
+	if s.config.DetectMult == 1 {
+		reduction = 10 + rand.IntN(16) // never exceed 90% of the interval
+	}
+	return interval * time.Duration(100-reduction) / 100
+}
+
+// detectionTime returns the time after which the session goes down if no
+// packet is received from the peer
+func (s *bfdSession) detectionTime() time.Duration {
+	return time.Duration(s.remoteDetectMult) * max(s.config.RequiredMinRx, s.remoteDesiredMinTx)
+}
+
+func (s *bfdSession) send(final bool) {
+	// A system must not transmit periodic packets if the peer asked for
+	// none
+	if s.remoteDetectMult != 0 && s.remoteRequiredMinRx == 0 && !final {
+		return
+	}
+	p := &bfdPacket{
+		Diag:              s.diag,
+		State:             s.State(),
+		Poll:              s.pollPending && !final,
+		Final:             final,
+		DetectMult:        s.config.DetectMult,
+		MyDiscriminator:   s.localDiscriminator,
+		YourDiscriminator: s.remoteDiscriminator,
+		DesiredMinTx:      s.desiredMinTx(),
+		RequiredMinRx:     s.config.RequiredMinRx,
+	}
+	if _, err := s.conn.Write(p.marshal()); err != nil {
+		log.WithFields(log.Fields{
+			"peer":  s.peer.String(),
+			"error": err,
+		}).Debug("Failed to send BFD packet")
+	}
+}
+
+// receive updates the session based on a received packet as described in
+// RFC 5880 section 6.8.6
+func (s *bfdSession) receive(p *bfdPacket) {
+	s.remoteDiscriminator = p.MyDiscriminator
+	s.remoteState = p.State
+	s.remoteDesiredMinTx = p.DesiredMinTx
+	s.remoteRequiredMinRx = p.RequiredMinRx
+	s.remoteDetectMult = p.DetectMult
+	if p.Final {
+		s.pollPending = false
+	}
+	state := s.State()
+	if state == bfdStateAdminDown {
+		return
+	}
+	if p.State == bfdStateAdminDown {
+		if state != bfdStateDown {
+			s.changeState(bfdStateDown, bfdDiagNeighborDown, true)
+		}
+	} else {
+		switch state {
+		case bfdStateDown:
+			if p.State == bfdStateDown {
+				s.setState(bfdStateInit, bfdDiagNone)
+			} else if p.State == bfdStateInit {
+				s.setState(bfdStateUp, bfdDiagNone)
+			}
+		case bfdStateInit:
+			if p.State == bfdStateInit || p.State == bfdStateUp {
+				s.setState(bfdStateUp, bfdDiagNone)
+			}
+		case bfdStateUp:
+			if p.State == bfdStateDown {
+				s.setState(bfdStateDown, bfdDiagNeighborDown)
+			}
+		}
+	}
+	if p.Poll {
+		s.send(true)
+	}
+}
+
+// run transmits periodic packets and handles the received ones until the
+// context is cancelled, when the peer is notified that the session is
+// administratively down
+func (s *bfdSession) run(ctx context.Context) {
+	defer s.conn.Close()
+	tx := time.NewTimer(0)
+	defer tx.Stop()
+	detect := time.NewTimer(time.Hour)
+	detect.Stop()
+	defer detect.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			s.setState(bfdStateAdminDown, bfdDiagAdminDown)
+			s.send(false)
+			return
+		case p := <-s.rx:
+			state := s.State()
+			s.receive(p)
+			detect.Reset(s.detectionTime())
+			if state != s.State() {
+				tx.Reset(s.txInterval())
+			}
+		case <-tx.C:
+			s.send(false)
+			tx.Reset(s.txInterval())
+		case <-detect.C:
+			state := s.State()
+			if state == bfdStateInit || state == bfdStateUp {
+				s.setState(bfdStateDown, bfdDiagControlDetectionExpired)
+				tx.Reset(s.txInterval())
+			}
+		}
+	}
+}
+
+// bfdServer receives the bfd control packets on a local address and
+// dispatches them to the sessions
+type bfdServer struct {
+	localAddr net.IP
+	port      int
+	device    string
+	conn      *ipv4.PacketConn
+
+	mu             sync.Mutex
+	sessions       map[string]*bfdSession // by peer address
+	discriminators map[uint32]*bfdSession
+}
+
+// newBFDServer listens for bfd control packets on the local address and port.
+// Sessions send their packets to the same port on the peer. If device is set,
+// all the sockets are bound to it, e.g. to a vrf.
+func newBFDServer(localAddr string, port int, device string) (*bfdServer, error) {
+	ip := net.ParseIP(localAddr).To4()
+	if ip == nil {
+		return nil, fmt.Errorf("invalid ipv4 address: %s", localAddr)
+	}
+	lc := net.ListenConfig{Control: bindToDevice(device)}
+	c, err := lc.ListenPacket(context.Background(), "udp4", net.JoinHostPort(ip.String(), strconv.Itoa(port)))
+	if err != nil {
+		return nil, fmt.Errorf("cannot listen for bfd packets: %v", err)
+	}
+	// Pick the allocated port when asked for any
+	port = c.LocalAddr().(*net.UDPAddr).Port
+	conn := ipv4.NewPacketConn(c)
+	if err := conn.SetControlMessage(ipv4.FlagTTL, true); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("cannot enable ttl control messages: %v", err)
+	}
+	return &bfdServer{
+		localAddr:      ip,
+		port:           port,
+		device:         device,
+		conn:           conn,
+		sessions:       make(map[string]*bfdSession),
+		discriminators: make(map[uint32]*bfdSession),
+	}, nil
+}
+
+// AddPeer starts a new bfd session toward the peer. The session stops when the
+// context is cancelled.
+func (bs *bfdServer) AddPeer(ctx context.Context, peer string, config bfdSessionConfig, onStateChange func(old, new bfdState, diag bfdDiag, remoteAdminDown bool)) (*bfdSession, error) {
+	ip := net.ParseIP(peer).To4()
+	if ip == nil {
+		return nil, fmt.Errorf("invalid ipv4 address: %s", peer)
+	}
+	if config.DetectMult == 0 {
+		return nil, errors.New("detect multiplier must not be zero")
+	}
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	if _, ok := bs.sessions[ip.String()]; ok {
+		return nil, fmt.Errorf("bfd session for %s already exists", peer)
+	}
+	conn, err := bs.dialPeer(ip)
+	if err != nil {
+		return nil, err
+	}
+	s := &bfdSession{
+		peer:               ip,
+		config:             config,
+		conn:               conn,
+		rx:                 make(chan *bfdPacket, 8),
+		onStateChange:      onStateChange,
+		localDiscriminator: bs.newDiscriminator(),
+	}
+	s.state.Store(uint32(bfdStateDown))
+	bs.sessions[ip.String()] = s
+	bs.discriminators[s.localDiscriminator] = s
+	go func() {
+		s.run(ctx)
+		bs.mu.Lock()
+		delete(bs.sessions, ip.String())
+		delete(bs.discriminators, s.localDiscriminator)
+		bs.mu.Unlock()
+	}()
+	return s, nil
+}
+
+// dialPeer returns a socket to send packets to the peer from a source port
+// within the range required by RFC 5881 section 4
+func (bs *bfdServer) dialPeer(peer net.IP) (*net.UDPConn, error) {
+	var err error
+	for range 16 {
+		port := bfdSourcePortMin + rand.IntN(bfdSourcePortMax-bfdSourcePortMin+1)
+		d := net.Dialer{
+			LocalAddr: &net.UDPAddr{IP: bs.localAddr, Port: port},
+			Control:   bindToDevice(bs.device),
+		}
+		var c net.Conn
+		c, err = d.Dial("udp4", net.JoinHostPort(peer.String(), strconv.Itoa(bs.port)))
+		if err != nil {
+			continue
+		}
+		conn := c.(*net.UDPConn)
+		if err = ipv4.NewConn(conn).SetTTL(bfdTTL); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("cannot set ttl: %v", err)
+		}
+		return conn, nil
+	}
+	return nil, fmt.Errorf("cannot bind bfd source port: %v", err)
+}
+
+// bindToDevice returns a socket control function that binds the socket to the
+// device, or nil if no device is set
+func bindToDevice(device string) func(network, address string, c syscall.RawConn) error {
+	if device == "" {
+		return nil
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		var err error
+		if cerr := c.Control(func(fd uintptr) {
+			err = unix.BindToDevice(int(fd), device)
+		}); cerr != nil {
+			return cerr
+		}
+		return err
+	}
+}
+
+// newDiscriminator returns a random non-zero discriminator that is not used by
+// another session. It must be called with the lock held.
+func (bs *bfdServer) newDiscriminator() uint32 {
+	for {
+		d := rand.Uint32()
+		if _, ok := bs.discriminators[d]; d != 0 && !ok {
+			return d
+		}
+	}
+}
+
+// Serve reads the incoming packets until the server is closed
+func (bs *bfdServer) Serve() {
+	buf := make([]byte, bfdReceiveBufferSz)
+	for {
+		n, cm, src, err := bs.conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.WithFields(log.Fields{"error": err}).Warn("Failed to read BFD packet")
+			continue
+		}
+		// Single-hop packets must have not been forwarded
+		if cm == nil || cm.TTL != bfdTTL {
+			continue
+		}
+		p, err := unmarshalBFDPacket(buf[:n])
+		if err != nil {
+			log.WithFields(log.Fields{
+				"source": src.String(),
+				"error":  err,
+			}).Debug("Discarding invalid BFD packet")
+			continue
+		}
+		udpAddr, ok := src.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		if s := bs.session(p, udpAddr.IP); s != nil {
+			select {
+			case s.rx <- p:
+			default:
+				// The session is not keeping up, drop the packet
+			}
+		}
+	}
+}
+
+// session returns the session a packet belongs to, using the discriminator
+// when set and the source address otherwise
+func (bs *bfdServer) session(p *bfdPacket, src net.IP) *bfdSession {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	var s *bfdSession
+	if p.YourDiscriminator != 0 {
+		s = bs.discriminators[p.YourDiscriminator]
+	} else {
+		s = bs.sessions[src.String()]
+	}
+	if s == nil || !s.peer.Equal(src) {
+		return nil
+	}
+	return s
+}
+
+// Close stops receiving packets
+func (bs *bfdServer) Close() error {
+	return bs.conn.Close()
+}
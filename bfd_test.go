@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testBFDSessionConfig = bfdSessionConfig{
+	DesiredMinTx:  50 * time.Millisecond,
+	RequiredMinRx: 50 * time.Millisecond,
+	DetectMult:    3,
+}
+
+// bfdTransitions records the state changes of a bfd session
+type bfdTransitions struct {
+	mu              sync.Mutex
+	diags           map[bfdState]bfdDiag
+	remoteAdminDown map[bfdState]bool
+}
+
+func (bt *bfdTransitions) record(_, new bfdState, diag bfdDiag, remoteAdminDown bool) {
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+	if bt.diags == nil {
+		bt.diags = make(map[bfdState]bfdDiag)
+		bt.remoteAdminDown = make(map[bfdState]bool)
+	}
+	bt.diags[new] = diag
+	bt.remoteAdminDown[new] = remoteAdminDown
+}
+
+func (bt *bfdTransitions) diag(state bfdState) (bfdDiag, bool) {
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+	d, ok := bt.diags[state]
+	return d, ok
+}
+
+// byRemoteAdminDown returns whether the peer brought the session to the state
+// administratively
+func (bt *bfdTransitions) byRemoteAdminDown(state bfdState) bool {
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+	return bt.remoteAdminDown[state]
+}
+
+// newTestBFDServers starts two bfd servers on different loopback addresses
+// that send packets to each other
+func newTestBFDServers(t *testing.T) (*bfdServer, *bfdServer) {
+	a, err := newBFDServer("127.0.0.1", 0, "")
+	require.NoError(t, err)
+	t.Cleanup(func() { a.Close() })
+	b, err := newBFDServer("127.0.0.2", a.port, "")
+	require.NoError(t, err)
+	t.Cleanup(func() { b.Close() })
+	go a.Serve()
+	go b.Serve()
+	return a, b
+}
+
+func TestBFDPacketRoundTrip(t *testing.T) {
+	p := &bfdPacket{
+		Diag:              bfdDiagNeighborDown,
+		State:             bfdStateUp,
+		Poll:              true,
+		DetectMult:        3,
+		MyDiscriminator:   1,
+		YourDiscriminator: 2,
+		DesiredMinTx:      300 * time.Millisecond,
+		RequiredMinRx:     time.Second,
+	}
+	got, err := unmarshalBFDPacket(p.marshal())
+	require.NoError(t, err)
+	assert.Equal(t, p, got)
+}
+
+func TestInvalidBFDPackets(t *testing.T) {
+	valid := &bfdPacket{
+		State:             bfdStateUp,
+		DetectMult:        3,
+		MyDiscriminator:   1,
+		YourDiscriminator: 2,
+	}
+	tests := []struct {
+		name   string
+		modify func(b []byte) []byte
+	}{
+		{"short", func(b []byte) []byte { return b[:20] }},
+		{"version", func(b []byte) []byte { b[0] = 2 << 5; return b }},
+		{"length", func(b []byte) []byte { b[3] = 30; return b }},
+		{"auth", func(b []byte) []byte { b[1] |= 0x04; return b }},
+		{"multipoint", func(b []byte) []byte { b[1] |= 0x01; return b }},
+		{"detect multiplier", func(b []byte) []byte { b[2] = 0; return b }},
+		{"my discriminator", func(b []byte) []byte { copy(b[4:8], []byte{0, 0, 0, 0}); return b }},
+		{"your discriminator", func(b []byte) []byte { copy(b[8:12], []byte{0, 0, 0, 0}); return b }},
+		{"poll and final", func(b []byte) []byte { b[1] |= 0x30; return b }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := unmarshalBFDPacket(tt.modify(valid.marshal()))
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestBFDSessionNeighborDown(t *testing.T) {
+	a, b := newTestBFDServers(t)
+	ta := &bfdTransitions{}
+	sa, err := a.AddPeer(t.Context(), "127.0.0.2", testBFDSessionConfig, ta.record)
+	require.NoError(t, err)
+	ctxB, cancelB := context.WithCancel(t.Context())
+	sb, err := b.AddPeer(ctxB, "127.0.0.1", testBFDSessionConfig, nil)
+	require.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		return sa.State() == bfdStateUp && sb.State() == bfdStateUp
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Stopping the session on b notifies a
+	cancelB()
+	assert.Eventually(t, func() bool {
+		return sa.State() == bfdStateDown
+	}, time.Second, 10*time.Millisecond)
+	diag, _ := ta.diag(bfdStateDown)
+	assert.Equal(t, bfdDiagNeighborDown, diag)
+	// which is told apart from a forwarding failure
+	assert.True(t, ta.byRemoteAdminDown(bfdStateDown))
+
+	// and a comes back up when b restarts
+	assert.Eventually(t, func() bool {
+		sb, err = b.AddPeer(t.Context(), "127.0.0.1", testBFDSessionConfig, nil)
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+	assert.Eventually(t, func() bool {
+		return sa.State() == bfdStateUp && sb.State() == bfdStateUp
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestBFDSessionDetectionTimeExpired(t *testing.T) {
+	a, b := newTestBFDServers(t)
+	sa, err := a.AddPeer(t.Context(), "127.0.0.2", testBFDSessionConfig, nil)
+	require.NoError(t, err)
+	tb := &bfdTransitions{}
+	sb, err := b.AddPeer(t.Context(), "127.0.0.1", testBFDSessionConfig, tb.record)
+	require.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		return sa.State() == bfdStateUp && sb.State() == bfdStateUp
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// b stops receiving packets from a. Until the poll sequences lowered
+	// the intervals, detection and transmission use the slow interval.
+	b.Close()
+	assert.Eventually(t, func() bool {
+		return sb.State() == bfdStateDown
+	}, 5*time.Second, 10*time.Millisecond)
+	diag, _ := tb.diag(bfdStateDown)
+	assert.Equal(t, bfdDiagControlDetectionExpired, diag)
+	assert.False(t, tb.byRemoteAdminDown(bfdStateDown))
+	// and a is notified about it
+	assert.Eventually(t, func() bool {
+		return sa.State() == bfdStateDown
+	}, 5*time.Second, 10*time.Millisecond)
+}
@@ -5,50 +5,185 @@ import (
 	"context"
 	"fmt"
 	"net/netip"
+	"sync"
 	"time"
 
 	"github.com/osrg/gobgp/v4/api"
 	"github.com/osrg/gobgp/v4/pkg/apiutil"
 	"github.com/osrg/gobgp/v4/pkg/packet/bgp"
 	"github.com/osrg/gobgp/v4/pkg/server"
-	"github.com/sirupsen/logrus"
 	log "github.com/sirupsen/logrus"
 )
 
+const (
+	defaultGracefulRestartTime = 120 // seconds
+	defaultBFDInterval         = 300 // milliseconds
+	defaultBFDDetectMultiplier = 3
+	peerMetricsInterval        = 10 * time.Second
+)
+
 var (
 	v4Family = &api.Family{Afi: api.Family_AFI_IP, Safi: api.Family_SAFI_UNICAST} // &gobgpapi.Family literal is not a constant
 )
 
 type BgpServer struct {
-	server *server.BgpServer
+	server          *server.BgpServer
+	gracefulRestart *gracefulRestartConfig
+	restarting      bool
+	vrf             string
+	bfd             *bfdServer
+	bfdCtx          context.Context
+	stopBFD         context.CancelFunc
+
+	mu         sync.Mutex
+	peerStates map[string]bgp.FSMState // the last known session state per peer address
 }
 
-func initBgpServer(routerId string, asn uint32, listenPort int32) (*BgpServer, error) {
+// initBgpServer starts a new bgp server. When gracefulRestart is not nil the
+// server and all the peers added later will advertise the graceful restart
+// capability, and restarting signals to the peers that the process is
+// recovering from a restart so they should keep the previously received paths
+// until the session is re-established. If vrf is set, the listening and peer
+// sockets are bound to it.
+func initBgpServer(routerId string, asn uint32, listenPort int32, vrf string, gracefulRestart *gracefulRestartConfig, restarting bool) (*BgpServer, error) {
 	s := server.NewBgpServer()
 	go s.Serve()
 
 	// global configuration
+	global := &api.Global{
+		Asn:          asn,
+		RouterId:     routerId,
+		ListenPort:   listenPort,
+		BindToDevice: vrf,
+	}
+	if gracefulRestart != nil {
+		global.GracefulRestart = &api.GracefulRestart{
+			Enabled:          true,
+			RestartTime:      gracefulRestartTime(gracefulRestart),
+			LonglivedEnabled: gracefulRestart.LongLivedRestartTime > 0,
+		}
+	}
 	if err := s.StartBgp(context.Background(), &api.StartBgpRequest{
-		Global: &api.Global{
-			Asn:        asn,
-			RouterId:   routerId,
-			ListenPort: listenPort,
-		},
+		Global: global,
 	}); err != nil {
 		return nil, err
 	}
 
+	bs := &BgpServer{
+		server:          s,
+		gracefulRestart: gracefulRestart,
+		restarting:      restarting,
+		vrf:             vrf,
+		peerStates:      make(map[string]bgp.FSMState),
+	}
 	// monitor the change of the peer state
 	if err := s.WatchEvent(context.Background(), server.WatchEventMessageCallbacks{
-		OnPeerUpdate: func(peer *apiutil.WatchEventMessage_PeerEvent, _ time.Time) {
-			if peer.Type == apiutil.PEER_EVENT_STATE {
-				log.Info(peer)
-			}
-		}}, server.WatchPeer()); err != nil {
-		log.Fatal(err)
+		OnPeerUpdate: bs.onPeerUpdate,
+	}, server.WatchPeer()); err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Fatal("Cannot watch bgp peer events")
 	}
 
-	return &BgpServer{server: s}, nil
+	return bs, nil
+}
+
+// onPeerUpdate logs the peer session state transitions, updates the session
+// state metric and notifies the sessions going up or down
+func (bs *BgpServer) onPeerUpdate(peer *apiutil.WatchEventMessage_PeerEvent, _ time.Time) {
+	if peer.Type != apiutil.PEER_EVENT_STATE {
+		return
+	}
+	address := peer.Peer.State.NeighborAddress.String()
+	state := peer.Peer.State.SessionState
+	bs.mu.Lock()
+	old := bs.peerStates[address]
+	bs.peerStates[address] = state
+	bs.mu.Unlock()
+
+	fields := log.Fields{
+		"peer":      address,
+		"peer_asn":  peer.Peer.State.PeerASN,
+		"old_state": old.String(),
+		"new_state": state.String(),
+	}
+	var reason string
+	if peer.Peer.State.DisconnectReason != api.PeerState_DISCONNECT_REASON_UNSPECIFIED {
+		reason = peer.Peer.State.DisconnectReason.String()
+		fields["reason"] = reason
+	}
+	if peer.Peer.State.DisconnectMessage != "" {
+		fields["reason_message"] = peer.Peer.State.DisconnectMessage
+	}
+	log.WithFields(fields).Info("BGP peer state changed")
+	setBGPPeerSessionStateMetric(address, toAPISessionState(state))
+	switch {
+	case state == bgp.BGP_FSM_ESTABLISHED && old != bgp.BGP_FSM_ESTABLISHED:
+		notifications.Notify(event{Type: eventPeerUp, Peer: address})
+	case state != bgp.BGP_FSM_ESTABLISHED && old == bgp.BGP_FSM_ESTABLISHED:
+		notifications.Notify(event{Type: eventPeerDown, Peer: address, Reason: reason})
+	}
+}
+
+// toAPISessionState converts a bgp fsm state to the api one, which is used as
+// the session state metric value
+func toAPISessionState(state bgp.FSMState) api.PeerState_SessionState {
+	switch state {
+	case bgp.BGP_FSM_IDLE:
+		return api.PeerState_SESSION_STATE_IDLE
+	case bgp.BGP_FSM_CONNECT:
+		return api.PeerState_SESSION_STATE_CONNECT
+	case bgp.BGP_FSM_ACTIVE:
+		return api.PeerState_SESSION_STATE_ACTIVE
+	case bgp.BGP_FSM_OPENSENT:
+		return api.PeerState_SESSION_STATE_OPENSENT
+	case bgp.BGP_FSM_OPENCONFIRM:
+		return api.PeerState_SESSION_STATE_OPENCONFIRM
+	case bgp.BGP_FSM_ESTABLISHED:
+		return api.PeerState_SESSION_STATE_ESTABLISHED
+	}
+	return api.PeerState_SESSION_STATE_UNSPECIFIED
+}
+
+// updatePeerMetrics exports the session statistics of all peers
+func (bs *BgpServer) updatePeerMetrics() error {
+	return bs.server.ListPeer(context.Background(), &api.ListPeerRequest{
+		EnableAdvertised: true,
+	}, func(p *api.Peer) {
+		if p.Conf == nil || p.State == nil {
+			return
+		}
+		address := p.Conf.NeighborAddress
+		setBGPPeerSessionStateMetric(address, p.State.SessionState)
+		setBGPPeerFlapsMetric(address, p.State.Flops)
+		uptime := time.Duration(0)
+		if p.State.SessionState == api.PeerState_SESSION_STATE_ESTABLISHED &&
+			p.Timers != nil && p.Timers.State != nil && p.Timers.State.Uptime != nil {
+			uptime = time.Since(p.Timers.State.Uptime.AsTime())
+		}
+		setBGPPeerUptimeMetric(address, uptime)
+		if p.State.Messages != nil {
+			setBGPPeerMessagesMetrics(address, p.State.Messages.Sent, p.State.Messages.Received)
+		}
+		for _, afiSafi := range p.AfiSafis {
+			if afiSafi.State == nil || afiSafi.State.Family == nil ||
+				afiSafi.State.Family.Afi != v4Family.Afi || afiSafi.State.Family.Safi != v4Family.Safi {
+				continue
+			}
+			setBGPPeerPrefixesMetrics(address, afiSafi.State.Accepted, afiSafi.State.Advertised)
+		}
+	})
+}
+
+// watchPeerMetrics periodically updates the peer session metrics
+func (bs *BgpServer) watchPeerMetrics() {
+	for t := time.Tick(peerMetricsInterval); ; <-t {
+		if err := bs.updatePeerMetrics(); err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+			}).Warn("Cannot list bgp peers")
+		}
+	}
 }
 
 func (bs *BgpServer) AddPeer(address string, asn uint32) error {
@@ -57,22 +192,58 @@ func (bs *BgpServer) AddPeer(address string, asn uint32) error {
 			NeighborAddress: address,
 			PeerAsn:         asn,
 		},
+		Transport: &api.Transport{
+			BindInterface: bs.vrf,
+		},
 	}
+	if bs.gracefulRestart != nil {
+		llgr := bs.gracefulRestart.LongLivedRestartTime > 0
+		n.GracefulRestart = &api.GracefulRestart{
+			Enabled:          true,
+			RestartTime:      gracefulRestartTime(bs.gracefulRestart),
+			LonglivedEnabled: llgr,
+			LocalRestarting:  bs.restarting,
+		}
+		// Graceful restart needs to be enabled per address family as well
+		afiSafi := &api.AfiSafi{
+			Config: &api.AfiSafiConfig{
+				Family:  v4Family,
+				Enabled: true,
+			},
+			MpGracefulRestart: &api.MpGracefulRestart{
+				Config: &api.MpGracefulRestartConfig{Enabled: true},
+			},
+		}
+		if llgr {
+			afiSafi.LongLivedGracefulRestart = &api.LongLivedGracefulRestart{
+				Config: &api.LongLivedGracefulRestartConfig{
+					Enabled:     true,
+					RestartTime: bs.gracefulRestart.LongLivedRestartTime,
+				},
+			}
+		}
+		n.AfiSafis = []*api.AfiSafi{afiSafi}
+	}
+	bs.mu.Lock()
+	bs.peerStates[address] = bgp.BGP_FSM_IDLE
+	bs.mu.Unlock()
+	setBGPPeerSessionStateMetric(address, api.PeerState_SESSION_STATE_IDLE)
 	return bs.server.AddPeer(context.Background(), &api.AddPeerRequest{Peer: n})
 }
 
-func (bs *BgpServer) AddV4Path(prefix string, prefixLen int, nextHop string) error {
-	path := fmt.Sprintf("%s/%d", prefix, prefixLen)
-	nlri, _ := bgp.NewIPAddrPrefix(netip.MustParsePrefix(path))
-	a1 := bgp.NewPathAttributeOrigin(0) // the prefix originates from an interior routing protocol (IGP)
-	a2, _ := bgp.NewPathAttributeNextHop(netip.MustParseAddr(nextHop))
-	attrs := []bgp.PathAttributeInterface{a1, a2}
+// gracefulRestartTime returns the configured restart time or the default one
+// if omitted from the config
+func gracefulRestartTime(gracefulRestart *gracefulRestartConfig) uint32 {
+	if gracefulRestart.RestartTime == 0 {
+		return defaultGracefulRestartTime
+	}
+	return gracefulRestart.RestartTime
+}
 
-	_, err := bs.server.AddPath(apiutil.AddPathRequest{Paths: []*apiutil.Path{{
-		Family: bgp.RF_IPv4_UC,
-		Nlri:   nlri,
-		Attrs:  attrs,
-	}}})
+func (bs *BgpServer) AddV4Path(prefix string, prefixLen int, nextHop string) error {
+	_, err := bs.server.AddPath(apiutil.AddPathRequest{Paths: []*apiutil.Path{
+		v4Path(prefix, prefixLen, nextHop),
+	}})
 	if err != nil {
 		return err
 	}
@@ -80,48 +251,192 @@ func (bs *BgpServer) AddV4Path(prefix string, prefixLen int, nextHop string) err
 	return nil
 }
 
+// GracefulShutdownV4Path re-announces the path tagged with the
+// GRACEFUL_SHUTDOWN well-known community (RFC 8326), so that the peers lower
+// its preference and move traffic away before the path is withdrawn.
+func (bs *BgpServer) GracefulShutdownV4Path(prefix string, prefixLen int, nextHop string) error {
+	path := v4Path(prefix, prefixLen, nextHop)
+	path.Attrs = append(path.Attrs, bgp.NewPathAttributeCommunities([]uint32{
+		uint32(bgp.COMMUNITY_PLANNED_SHUT), // 65535:0 GRACEFUL_SHUTDOWN
+	}))
+	_, err := bs.server.AddPath(apiutil.AddPathRequest{Paths: []*apiutil.Path{path}})
+	return err
+}
+
 func (bs *BgpServer) DeleteV4Path(prefix string, prefixLen int, nextHop string) error {
+	err := bs.server.DeletePath(apiutil.DeletePathRequest{Paths: []*apiutil.Path{
+		v4Path(prefix, prefixLen, nextHop),
+	}})
+	if err != nil {
+		return err
+	}
+	unsetBGPPathAdvertisementMetric(prefix, fmt.Sprint(prefixLen), nextHop)
+	return nil
+}
+
+// V4PathAdvertisements returns whether the path is in the local rib and, for
+// every established peer, whether it is included in the peer Adj-RIB-Out, i.e.
+// it has been sent to the peer
+func (bs *BgpServer) V4PathAdvertisements(prefix string, prefixLen int) (bool, map[string]bool, error) {
+	lookup := []*apiutil.LookupPrefix{{Prefix: fmt.Sprintf("%s/%d", prefix, prefixLen)}}
+	inTable := func(tableType api.TableType, name string) (bool, error) {
+		found := false
+		err := bs.server.ListPath(apiutil.ListPathRequest{
+			TableType: tableType,
+			Name:      name,
+			Family:    bgp.RF_IPv4_UC,
+			Prefixes:  lookup,
+		}, func(_ bgp.NLRI, paths []*apiutil.Path) {
+			if len(paths) > 0 {
+				found = true
+			}
+		})
+		return found, err
+	}
+	local, err := inTable(api.TableType_TABLE_TYPE_GLOBAL, "")
+	if err != nil {
+		return false, nil, err
+	}
+	var established []string
+	if err := bs.server.ListPeer(context.Background(), &api.ListPeerRequest{}, func(p *api.Peer) {
+		if p.Conf != nil && p.State != nil && p.State.SessionState == api.PeerState_SESSION_STATE_ESTABLISHED {
+			established = append(established, p.Conf.NeighborAddress)
+		}
+	}); err != nil {
+		return false, nil, err
+	}
+	peers := make(map[string]bool, len(established))
+	for _, address := range established {
+		advertised, err := inTable(api.TableType_TABLE_TYPE_ADJ_OUT, address)
+		if err != nil {
+			return false, nil, err
+		}
+		peers[address] = advertised
+	}
+	return local, peers, nil
+}
+
+// v4Path returns an ipv4 unicast path for the given prefix via the next hop
+func v4Path(prefix string, prefixLen int, nextHop string) *apiutil.Path {
 	path := fmt.Sprintf("%s/%d", prefix, prefixLen)
 	nlri, _ := bgp.NewIPAddrPrefix(netip.MustParsePrefix(path))
 	a1 := bgp.NewPathAttributeOrigin(0) // the prefix originates from an interior routing protocol (IGP)
 	a2, _ := bgp.NewPathAttributeNextHop(netip.MustParseAddr(nextHop))
-	attrs := []bgp.PathAttributeInterface{a1, a2}
-
-	err := bs.server.DeletePath(apiutil.DeletePathRequest{Paths: []*apiutil.Path{{
+	return &apiutil.Path{
 		Family: bgp.RF_IPv4_UC,
 		Nlri:   nlri,
-		Attrs:  attrs,
-	}}})
-	if err != nil {
-		return err
+		Attrs:  []bgp.PathAttributeInterface{a1, a2},
 	}
-	unsetBGPPathAdvertisementMetric(prefix, fmt.Sprint(prefixLen), nextHop)
-	return nil
 }
 
 func (bs *BgpServer) ListV4Paths() {
 	bs.server.ListPath(apiutil.ListPathRequest{
 		TableType: api.TableType_TABLE_TYPE_GLOBAL,
 	}, func(prefix bgp.NLRI, paths []*apiutil.Path) {
-		log.Info(prefix.String())
 		for _, p := range paths {
-			log.WithFields(logrus.Fields{
-				"peer_asn":     p.PeerASN,
-				"peer_address": p.PeerAddress,
-				"age":          p.Age,
-				"best":         p.Best,
+			log.WithFields(log.Fields{
+				"prefix":   prefix.String(),
+				"peer":     p.PeerAddress,
+				"peer_asn": p.PeerASN,
+				"age":      p.Age,
+				"best":     p.Best,
 			}).Info("path")
 		}
 	})
 }
 
+// AddBFDPeer starts a bfd session toward a bgp peer. When the bfd session goes
+// down the bgp peer is disabled, so the session is torn down without waiting
+// for the hold timer to expire, and it gets enabled again when bfd comes back
+// up.
+func (bs *BgpServer) AddBFDPeer(localAddress, address string, bfdConfig bfdConfig) error {
+	if bs.bfd == nil {
+		bfd, err := newBFDServer(localAddress, bfdPort, bs.vrf)
+		if err != nil {
+			return err
+		}
+		go bfd.Serve()
+		bs.bfd = bfd
+		bs.bfdCtx, bs.stopBFD = context.WithCancel(context.Background())
+	}
+	config := bfdSessionConfig{
+		DesiredMinTx:  bfdInterval(bfdConfig.DesiredMinTxMs),
+		RequiredMinRx: bfdInterval(bfdConfig.RequiredMinRxMs),
+		DetectMult:    bfdConfig.DetectMultiplier,
+	}
+	if config.DetectMult == 0 {
+		config.DetectMult = defaultBFDDetectMultiplier
+	}
+	setBFDSessionStateMetric(address, bfdStateDown)
+	_, err := bs.bfd.AddPeer(bs.bfdCtx, address, config, bs.bfdStateChange(address))
+	return err
+}
+
+// bfdStateChange returns a callback that disables and enables the bgp peer
+// based on the state of its bfd session
+func (bs *BgpServer) bfdStateChange(address string) func(old, new bfdState, diag bfdDiag, remoteAdminDown bool) {
+	disabled := false // only accessed from the bfd session goroutine
+	return func(old, new bfdState, diag bfdDiag, remoteAdminDown bool) {
+		setBFDSessionStateMetric(address, new)
+		// Leave the bgp session alone when bfd is stopped locally, so that
+		// graceful restart can kick in, and when the peer stops it, as that
+		// is no forwarding failure
+		if old == bfdStateUp && new == bfdStateDown && !remoteAdminDown {
+			if err := bs.server.DisablePeer(context.Background(), &api.DisablePeerRequest{
+				Address:       address,
+				Communication: fmt.Sprintf("BFD session down: %s", diag),
+			}); err != nil {
+				log.WithFields(log.Fields{
+					"peer":  address,
+					"error": err,
+				}).Error("Cannot disable bgp peer")
+				return
+			}
+			disabled = true
+		}
+		if new == bfdStateUp && disabled {
+			if err := bs.server.EnablePeer(context.Background(), &api.EnablePeerRequest{
+				Address: address,
+			}); err != nil {
+				log.WithFields(log.Fields{
+					"peer":  address,
+					"error": err,
+				}).Error("Cannot enable bgp peer")
+				return
+			}
+			disabled = false
+		}
+	}
+}
+
+// bfdInterval converts an interval in milliseconds to a duration, falling back
+// to the default one if omitted from the config
+func bfdInterval(ms uint32) time.Duration {
+	if ms == 0 {
+		ms = defaultBFDInterval
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+// Stop closes all the peer and bfd sessions and stops the bgp server
+func (bs *BgpServer) Stop() error {
+	if bs.bfd != nil {
+		bs.stopBFD()
+		bs.bfd.Close()
+	}
+	return bs.server.StopBgp(context.Background(), &api.StopBgpRequest{})
+}
+
 // bgpSetup starts the bgp server and adds the peers
-func bgpSetup(bgpConfig bgpConfig) *BgpServer {
+func bgpSetup(bgpConfig bgpConfig, restarting bool) *BgpServer {
 	// Start bgp server
 	bgp, err := initBgpServer(
 		bgpConfig.Local.RouterId,
 		bgpConfig.Local.AS,
 		bgpConfig.Local.ListenPort,
+		bgpConfig.Local.VRF,
+		bgpConfig.GracefulRestart,
+		restarting,
 	)
 	if err != nil {
 		log.WithFields(log.Fields{
@@ -135,6 +450,15 @@ func bgpSetup(bgpConfig bgpConfig) *BgpServer {
 				"error": err,
 			}).Fatal("Cannot add bgpp peer")
 		}
+		if peer.BFD != nil {
+			if err := bgp.AddBFDPeer(bgpConfig.Local.RouterId, peer.Address, *peer.BFD); err != nil {
+				log.WithFields(log.Fields{
+					"error": err,
+					"peer":  peer.Address,
+				}).Fatal("Cannot add bfd peer")
+			}
+		}
 	}
+	go bgp.watchPeerMetrics()
 	return bgp
 }
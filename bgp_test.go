@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/osrg/gobgp/v4/api"
+	"github.com/osrg/gobgp/v4/pkg/packet/bgp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBgpServerAdvertise(t *testing.T) {
+	bs, router := newTestBgpServer(t)
+	router.WaitEstablished(t)
+
+	require.NoError(t, bs.AddV4Path("10.88.2.1", 32, testLocalRouterID))
+	router.WaitPath(t, "10.88.2.1/32", func(p receivedPath) bool {
+		return p.nextHop == testLocalRouterID && len(p.communities) == 0
+	})
+	local, peers, err := bs.V4PathAdvertisements("10.88.2.1", 32)
+	require.NoError(t, err)
+	assert.True(t, local)
+	assert.Equal(t, map[string]bool{"127.0.0.1": true}, peers)
+
+	require.NoError(t, bs.GracefulShutdownV4Path("10.88.2.1", 32, testLocalRouterID))
+	router.WaitPath(t, "10.88.2.1/32", func(p receivedPath) bool {
+		return assert.ObjectsAreEqual([]uint32{uint32(bgp.COMMUNITY_PLANNED_SHUT)}, p.communities)
+	})
+
+	require.NoError(t, bs.DeleteV4Path("10.88.2.1", 32, testLocalRouterID))
+	router.WaitWithdrawn(t, "10.88.2.1/32")
+	local, peers, err = bs.V4PathAdvertisements("10.88.2.1", 32)
+	require.NoError(t, err)
+	assert.False(t, local)
+	assert.Equal(t, map[string]bool{"127.0.0.1": false}, peers)
+}
+
+func TestBgpServerPeerMetrics(t *testing.T) {
+	bs, router := newTestBgpServer(t)
+	sessionState := func() float64 {
+		return testutil.ToFloat64(bgpPeerSessionState.WithLabelValues("127.0.0.1"))
+	}
+	assertFlaps := func(flaps int) {
+		t.Helper()
+		expected := fmt.Sprintf(`
+# HELP bgp_lb_bgp_peer_flaps_total Number of times the session with a bgp peer went down after being established.
+# TYPE bgp_lb_bgp_peer_flaps_total counter
+bgp_lb_bgp_peer_flaps_total{peer="127.0.0.1"} %d
+`, flaps)
+		assert.NoError(t, testutil.CollectAndCompare(bgpPeerCounters, strings.NewReader(expected), "bgp_lb_bgp_peer_flaps_total"))
+	}
+	// The session state follows the peer updates
+	router.WaitEstablished(t)
+	require.Eventually(t, func() bool {
+		return sessionState() == float64(api.PeerState_SESSION_STATE_ESTABLISHED)
+	}, testRouterTimeout, testRouterInterval)
+
+	require.NoError(t, bs.AddV4Path("10.88.2.1", 32, testLocalRouterID))
+	router.WaitPath(t, "10.88.2.1/32", func(receivedPath) bool { return true })
+	require.NoError(t, bs.updatePeerMetrics())
+	assert.Equal(t, float64(api.PeerState_SESSION_STATE_ESTABLISHED), sessionState())
+	assertFlaps(0)
+	assert.Equal(t, 5, testutil.CollectAndCount(bgpPeerCounters, "bgp_lb_bgp_peer_messages_sent_total"))
+	assert.Equal(t, 1.0, testutil.ToFloat64(bgpPeerAdvertisedPrefixes.WithLabelValues("127.0.0.1")))
+	assert.Equal(t, 0.0, testutil.ToFloat64(bgpPeerAcceptedPrefixes.WithLabelValues("127.0.0.1")))
+
+	// The session goes down when the router disables the peer
+	require.NoError(t, router.server.DisablePeer(context.Background(), &api.DisablePeerRequest{Address: "127.0.0.1"}))
+	require.Eventually(t, func() bool {
+		return sessionState() != float64(api.PeerState_SESSION_STATE_ESTABLISHED)
+	}, testRouterTimeout, testRouterInterval)
+	require.NoError(t, bs.updatePeerMetrics())
+	assertFlaps(1)
+
+	// And comes back up, advertising the path again
+	require.NoError(t, router.server.EnablePeer(context.Background(), &api.EnablePeerRequest{Address: "127.0.0.1"}))
+	router.WaitEstablished(t)
+	router.WaitPath(t, "10.88.2.1/32", func(receivedPath) bool { return true })
+	require.Eventually(t, func() bool {
+		if bs.updatePeerMetrics() != nil {
+			return false
+		}
+		return sessionState() == float64(api.PeerState_SESSION_STATE_ESTABLISHED) &&
+			testutil.ToFloat64(bgpPeerAdvertisedPrefixes.WithLabelValues("127.0.0.1")) == 1
+	}, testRouterTimeout, testRouterInterval)
+	assertFlaps(1)
+}
+
+func TestBgpServerBFDStateChange(t *testing.T) {
+	bs, router := newTestBgpServer(t)
+	router.WaitEstablished(t)
+	adminDown := func() bool {
+		down := false
+		bs.server.ListPeer(context.Background(), &api.ListPeerRequest{Address: "127.0.0.1"}, func(p *api.Peer) {
+			down = p.State != nil && p.State.AdminState == api.PeerState_ADMIN_STATE_DOWN
+		})
+		return down
+	}
+	onStateChange := bs.bfdStateChange("127.0.0.1")
+
+	// The peer stopping bfd is not a forwarding failure
+	onStateChange(bfdStateUp, bfdStateDown, bfdDiagNeighborDown, true)
+	assert.False(t, adminDown())
+
+	// Unlike the session going down
+	onStateChange(bfdStateDown, bfdStateUp, bfdDiagNone, false)
+	onStateChange(bfdStateUp, bfdStateDown, bfdDiagControlDetectionExpired, false)
+	assert.Eventually(t, adminDown, testRouterTimeout, testRouterInterval)
+	onStateChange(bfdStateDown, bfdStateUp, bfdDiagNone, false)
+	assert.Eventually(t, func() bool { return !adminDown() }, testRouterTimeout, testRouterInterval)
+}
+
+func TestServiceControllerAdvertise(t *testing.T) {
+	bs, router := newTestBgpServer(t)
+	router.WaitEstablished(t)
+	c := &config{
+		Bgp:     bgpConfig{Local: localConfig{RouterId: testLocalRouterID}},
+		Service: serviceConfig{Name: "ingress", IP: "10.88.2.1", PrefixLength: 32},
+	}
+	check := &fakeCheck{}
+	destinations := newDestinationPool(c.Service.IP, "", newFakeLoadBalancer())
+	controller := NewServiceController(c, check, bs, destinations, nil, false, &fakeClock{})
+
+	// The path follows the health of the service
+	for _, healthy := range []bool{true, false, true, false} {
+		check.healthy = healthy
+		controller.Step()
+		if healthy {
+			router.WaitPath(t, "10.88.2.1/32", func(p receivedPath) bool { return p.nextHop == testLocalRouterID })
+		} else {
+			router.WaitWithdrawn(t, "10.88.2.1/32")
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
 	"os"
@@ -8,44 +9,156 @@ import (
 
 // config includes all the config
 type config struct {
-	Bgp     bgpConfig     `json:"bgp"`
-	Service serviceConfig `json:"service"`
+	Bgp      bgpConfig       `json:"bgp"`
+	Service  serviceConfig   `json:"service"`
+	IPVSSync *ipvsSyncConfig `json:"ipvsSync"`
+	Webhooks []webhookConfig `json:"webhooks"`
+	// hash is the sha256 of the config file content
+	hash string
+}
+
+// ipvsSyncConfig contains the ipvs connection sync daemons to run, "master"
+// to send and "backup" to receive the connection state over multicast on the
+// interface. Nodes sharing a service should use the same sync id
+type ipvsSyncConfig struct {
+	States    []string `json:"states"`
+	Interface string   `json:"interface"`
+	SyncID    uint8    `json:"syncID"`
+}
+
+// webhookConfig contains a webhook that receives the service events as json,
+// signed with HMAC-SHA256 when a secret is set. The name, which defaults to the
+// url host, is used in the logs and metrics instead of the url. Only the listed
+// events are sent, all of them if none. Events are sent in batches of up to
+// batchSize, waiting up to batchIntervalMs for a batch to fill, and failed
+// deliveries are retried up to maxRetries times (5 if unset) with an
+// exponential backoff. Zero values default to 10 events, 1 second and a 5
+// seconds timeout.
+type webhookConfig struct {
+	Name            string   `json:"name"`
+	URL             string   `json:"url"`
+	Secret          string   `json:"secret"`
+	Events          []string `json:"events"`
+	BatchSize       int      `json:"batchSize"`
+	BatchIntervalMs int      `json:"batchIntervalMs"`
+	MaxRetries      *int     `json:"maxRetries"`
+	TimeoutSeconds  int      `json:"timeoutSeconds"`
 }
 
 // bgpConfig includes config for bgp peers and the local bgp server
 type bgpConfig struct {
-	Peers []peerConfig `json:"peers"`
-	Local localConfig  `json:"local"`
+	Peers           []peerConfig           `json:"peers"`
+	Local           localConfig            `json:"local"`
+	GracefulRestart *gracefulRestartConfig `json:"gracefulRestart"`
+	// GracefulShutdownSeconds is the time to wait after tagging a path with
+	// the GRACEFUL_SHUTDOWN community before withdrawing it. Zero disables
+	// graceful shutdown
+	GracefulShutdownSeconds int `json:"gracefulShutdownSeconds"`
 }
 
 // peerConfig contains the config for a bgp peer
 type peerConfig struct {
-	Address string `json:"address"`
-	AS      uint32 `json:"as"`
+	Address string     `json:"address"`
+	AS      uint32     `json:"as"`
+	BFD     *bfdConfig `json:"bfd"`
 }
 
-// localConfig contains the bgp config for the local server
+// bfdConfig contains the timers of a bfd session toward a bgp peer
+type bfdConfig struct {
+	DesiredMinTxMs   uint32 `json:"desiredMinTxMs"`
+	RequiredMinRxMs  uint32 `json:"requiredMinRxMs"`
+	DetectMultiplier uint8  `json:"detectMultiplier"`
+}
+
+// localConfig contains the bgp config for the local server. If a vrf is set,
+// the bgp and bfd sockets are bound to it.
 type localConfig struct {
 	RouterId   string `json:"routerID"`
 	AS         uint32 `json:"as"`
 	ListenPort int32  `json:"listenPort"`
+	VRF        string `json:"vrf"`
+}
+
+// gracefulRestartConfig contains the bgp graceful restart (RFC 4724) and
+// long-lived graceful restart settings. Long-lived graceful restart is enabled
+// when a non zero long-lived restart time is set
+type gracefulRestartConfig struct {
+	RestartTime          uint32 `json:"restartTime"`
+	LongLivedRestartTime uint32 `json:"longLivedRestartTime"`
 }
 
-// serviceConfig contains the advertised service ip and the healthcheck
+// serviceConfig contains the advertised service ip and the healthcheck. The
+// service ip is bound to a dummy device named after the service, unless an
+// existing device (e.g. lo) is set. The device, addresses and ipvs services
+// are set up in the network namespace at the netns path, if set, and the
+// device is enslaved to the vrf, if set.
 type serviceConfig struct {
 	Name            string                 `json:"name"`
+	Device          string                 `json:"device"`
+	Netns           string                 `json:"netns"`
+	VRF             string                 `json:"vrf"`
 	IP              string                 `json:"ip"`
 	PrefixLength    int                    `json:"prefixLength"`
 	Ports           []servicePortConfig    `json:"ports"`
 	Protocol        string                 `json:"protocol"`
+	IPVS            *ipvsServiceConfig     `json:"ipvs"`
 	HttpHealthCheck *httpHealthCheckConfig `json:"httphealthcheck"`
 	PingHealthCheck *pingHealthCheckConfig `json:"pinghealthcheck"`
+	ArpSuppression  *arpSuppressionConfig  `json:"arpSuppression"`
 }
 
-// servicePortsConfig contains the mapping between a service and a local port
+// arpSuppressionConfig contains the arp_ignore, arp_announce and ipv6
+// ndisc_notify values to set on the interfaces (default "all"), so that the
+// host does not answer or announce the service ip on other interfaces. Unset
+// values default to arp_ignore 1, arp_announce 2 and ndisc_notify 0.
+type arpSuppressionConfig struct {
+	Interfaces  []string `json:"interfaces"`
+	ArpIgnore   *int     `json:"arpIgnore"`
+	ArpAnnounce *int     `json:"arpAnnounce"`
+	NdiscNotify *int     `json:"ndiscNotify"`
+}
+
+// ipvsServiceConfig contains the ipvs virtual service options. Scheduler flags
+// ("fallback", "port") are only supported by the sh and mh schedulers and
+// persistence is enabled by a non zero timeout. If a firewall mark is set, a
+// single fwmark ipvs service is created for all the ports. A non zero drain
+// timeout drains the destinations after the service path is withdrawn, until
+// the active connections drop to the drain threshold.
+type ipvsServiceConfig struct {
+	FWMark              uint32   `json:"fwmark"`
+	Scheduler           string   `json:"scheduler"`
+	SchedulerFlags      []string `json:"schedulerFlags"`
+	PersistenceTimeout  uint32   `json:"persistenceTimeout"`
+	PersistenceNetmask  int      `json:"persistenceNetmask"`
+	DrainTimeoutSeconds int      `json:"drainTimeoutSeconds"`
+	DrainThreshold      int      `json:"drainThreshold"`
+}
+
+// servicePortsConfig contains the mapping between a service and a local port,
+// and the ipvs forwarding method (masq|dr|tunnel) and weight of the
+// destination. If real servers are listed, they are used as the ipvs
+// destinations instead of the local port. A range of ports can be defined by
+// setting an end port, in which case target ports are offset accordingly. The
+// protocol defaults to the service one
 type servicePortConfig struct {
-	ServicePort uint16 `json:"servicePort"`
-	TargetPort  uint16 `json:"targetLocalPort"`
+	ServicePort      uint16             `json:"servicePort"`
+	ServicePortEnd   uint16             `json:"servicePortEnd"`
+	Protocol         string             `json:"protocol"`
+	TargetPort       uint16             `json:"targetLocalPort"`
+	ForwardingMethod string             `json:"forwardingMethod"`
+	Weight           *int               `json:"weight"`
+	RealServers      []realServerConfig `json:"realServers"`
+}
+
+// realServerConfig contains an ipvs destination of a service port and its
+// healthcheck
+type realServerConfig struct {
+	Address          string                 `json:"address"`
+	Port             uint16                 `json:"port"`
+	ForwardingMethod string                 `json:"forwardingMethod"`
+	Weight           *int                   `json:"weight"`
+	HttpHealthCheck  *httpHealthCheckConfig `json:"httphealthcheck"`
+	PingHealthCheck  *pingHealthCheckConfig `json:"pinghealthcheck"`
 }
 
 // httpHealthCheckConfig contains the local port the http health endpoint listens to
@@ -61,6 +174,14 @@ type pingHealthCheckConfig struct {
 	Addresses []string `json:"addresses"`
 }
 
+// serviceDeviceName returns the name of the device to bind the service ip to
+func serviceDeviceName(serviceConfig serviceConfig) string {
+	if serviceConfig.Device != "" {
+		return serviceConfig.Device
+	}
+	return serviceConfig.Name
+}
+
 func readConfig(path string) (*config, error) {
 	// Default service prefix to /32 to avoid using /0 if omitted from the
 	// config file
@@ -76,5 +197,6 @@ func readConfig(path string) (*config, error) {
 	if err = json.Unmarshal(fileContent, conf); err != nil {
 		return nil, fmt.Errorf("error unmarshalling config: %v", err)
 	}
+	conf.hash = fmt.Sprintf("%x", sha256.Sum256(fileContent))
 	return conf, nil
 }
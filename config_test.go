@@ -14,7 +14,12 @@ func TestConfigFmt(t *testing.T) {
     "peers": [
       {
         "address": "10.88.0.253",
-	"as": 65512
+	"as": 65512,
+	"bfd": {
+	  "desiredMinTxMs": 300,
+	  "requiredMinRxMs": 300,
+	  "detectMultiplier": 3
+	}
       },
       {
         "address": "10.88.0.254",
@@ -25,7 +30,12 @@ func TestConfigFmt(t *testing.T) {
       "routerID": "10.88.0.200",
       "as": 65512,
       "listenPort": -1
-    }
+    },
+    "gracefulRestart": {
+      "restartTime": 120,
+      "longLivedRestartTime": 3600
+    },
+    "gracefulShutdownSeconds": 30
   },
   "service": {
     "name": "matchbox",
@@ -37,10 +47,49 @@ func TestConfigFmt(t *testing.T) {
       },
       {
         "servicePort": 443,
-        "targetLocalPort": 8081
+        "targetLocalPort": 8081,
+        "forwardingMethod": "masq",
+        "weight": 2
+      },
+      {
+        "servicePort": 53,
+        "protocol": "udp",
+        "targetLocalPort": 5353
+      },
+      {
+        "servicePort": 9000,
+        "servicePortEnd": 9010,
+        "targetLocalPort": 19000
+      },
+      {
+        "servicePort": 8443,
+        "realServers": [
+          {
+            "address": "10.88.1.10",
+            "port": 8443,
+            "forwardingMethod": "dr",
+            "weight": 1,
+            "httphealthcheck": {
+              "path": "healthz",
+              "port": 8080
+            }
+          },
+          {
+            "address": "10.88.1.11",
+            "port": 8443
+          }
+        ]
       }
     ],
     "protocol": "tcp",
+    "ipvs": {
+      "scheduler": "mh",
+      "schedulerFlags": ["fallback", "port"],
+      "persistenceTimeout": 300,
+      "persistenceNetmask": 24,
+      "drainTimeoutSeconds": 60,
+      "drainThreshold": 10
+    },
     "httphealthcheck": {
       "port": 8080
     },
@@ -50,6 +99,11 @@ func TestConfigFmt(t *testing.T) {
         "8.8.8.8"
       ]
     }
+  },
+  "ipvsSync": {
+    "states": ["master", "backup"],
+    "interface": "eth0",
+    "syncID": 7
   }
 }
 `)
@@ -66,21 +120,51 @@ func TestConfigFmt(t *testing.T) {
 	assert.Equal(t, 2, len(conf.Bgp.Peers))
 	assert.Equal(t, "10.88.0.253", conf.Bgp.Peers[0].Address)
 	assert.Equal(t, uint32(65512), conf.Bgp.Peers[0].AS)
+	assert.Equal(t, uint32(300), conf.Bgp.Peers[0].BFD.DesiredMinTxMs)
+	assert.Equal(t, uint32(300), conf.Bgp.Peers[0].BFD.RequiredMinRxMs)
+	assert.Equal(t, uint8(3), conf.Bgp.Peers[0].BFD.DetectMultiplier)
+	assert.Nil(t, conf.Bgp.Peers[1].BFD)
 	assert.Equal(t, "10.88.0.254", conf.Bgp.Peers[1].Address)
 	assert.Equal(t, uint32(65512), conf.Bgp.Peers[1].AS)
 	assert.Equal(t, "10.88.0.200", conf.Bgp.Local.RouterId)
 	assert.Equal(t, uint32(65512), conf.Bgp.Local.AS)
 	assert.Equal(t, int32(-1), conf.Bgp.Local.ListenPort)
+	assert.Equal(t, uint32(120), conf.Bgp.GracefulRestart.RestartTime)
+	assert.Equal(t, uint32(3600), conf.Bgp.GracefulRestart.LongLivedRestartTime)
+	assert.Equal(t, 30, conf.Bgp.GracefulShutdownSeconds)
 	assert.Equal(t, "matchbox", conf.Service.Name)
 	assert.Equal(t, "10.88.2.1", conf.Service.IP)
 	assert.Equal(t, 32, conf.Service.PrefixLength)
-	assert.Equal(t, 2, len(conf.Service.Ports))
+	assert.Equal(t, 5, len(conf.Service.Ports))
 	assert.Equal(t, uint16(80), conf.Service.Ports[0].ServicePort)
 	assert.Equal(t, uint16(8080), conf.Service.Ports[0].TargetPort)
 	assert.Equal(t, uint16(443), conf.Service.Ports[1].ServicePort)
 	assert.Equal(t, uint16(8081), conf.Service.Ports[1].TargetPort)
+	assert.Nil(t, conf.Service.Ports[0].Weight)
+	assert.Equal(t, "masq", conf.Service.Ports[1].ForwardingMethod)
+	assert.Equal(t, 2, *conf.Service.Ports[1].Weight)
+	assert.Equal(t, "", conf.Service.Ports[1].Protocol)
+	assert.Equal(t, "udp", conf.Service.Ports[2].Protocol)
+	assert.Equal(t, uint16(9000), conf.Service.Ports[3].ServicePort)
+	assert.Equal(t, uint16(9010), conf.Service.Ports[3].ServicePortEnd)
+	assert.Equal(t, uint16(19000), conf.Service.Ports[3].TargetPort)
+	assert.Equal(t, 2, len(conf.Service.Ports[4].RealServers))
+	assert.Equal(t, "10.88.1.10", conf.Service.Ports[4].RealServers[0].Address)
+	assert.Equal(t, uint16(8443), conf.Service.Ports[4].RealServers[0].Port)
+	assert.Equal(t, "dr", conf.Service.Ports[4].RealServers[0].ForwardingMethod)
+	assert.Equal(t, 8080, conf.Service.Ports[4].RealServers[0].HttpHealthCheck.Port)
+	assert.Nil(t, conf.Service.Ports[4].RealServers[1].HttpHealthCheck)
 	assert.Equal(t, "tcp", conf.Service.Protocol)
+	assert.Equal(t, "mh", conf.Service.IPVS.Scheduler)
+	assert.Equal(t, []string{"fallback", "port"}, conf.Service.IPVS.SchedulerFlags)
+	assert.Equal(t, uint32(300), conf.Service.IPVS.PersistenceTimeout)
+	assert.Equal(t, 24, conf.Service.IPVS.PersistenceNetmask)
+	assert.Equal(t, 60, conf.Service.IPVS.DrainTimeoutSeconds)
+	assert.Equal(t, 10, conf.Service.IPVS.DrainThreshold)
 	assert.Equal(t, 8080, conf.Service.HttpHealthCheck.Port)
 	assert.Equal(t, "1.1.1.1", conf.Service.PingHealthCheck.Addresses[0])
 	assert.Equal(t, "8.8.8.8", conf.Service.PingHealthCheck.Addresses[1])
+	assert.Equal(t, []string{"master", "backup"}, conf.IPVSSync.States)
+	assert.Equal(t, "eth0", conf.IPVSSync.Interface)
+	assert.Equal(t, uint8(7), conf.IPVSSync.SyncID)
 }
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	healthCheckInterval = time.Second
+	minBGPRetryInterval = time.Second
+	maxBGPRetryInterval = time.Minute
+)
+
+// Reasons of the service transitions, exported in the transition metrics
+const (
+	reasonHealthy               = "healthy"
+	reasonHealthCheckFailed     = "healthcheck_failed"
+	reasonNoHealthyDestinations = "no_healthy_destinations"
+	reasonAddressNotReady       = "address_not_ready"
+	reasonShutdown              = "shutdown"
+)
+
+// clock is the time source of the controller, replaced in tests
+type clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// advertiser announces and withdraws the service path to the bgp peers
+type advertiser interface {
+	AddV4Path(prefix string, prefixLen int, nextHop string) error
+	GracefulShutdownV4Path(prefix string, prefixLen int, nextHop string) error
+	DeleteV4Path(prefix string, prefixLen int, nextHop string) error
+	V4PathAdvertisements(prefix string, prefixLen int) (bool, map[string]bool, error)
+	ListV4Paths()
+}
+
+// ServiceController advertises the service path while the service is healthy
+// and withdraws it otherwise. Failed transitions are retried with an
+// exponential backoff.
+type ServiceController struct {
+	config       *config
+	check        Checker
+	advertiser   advertiser
+	destinations *destinationPool
+	// device is nil without network setup
+	device          *serviceDevice
+	bindOnAdvertise bool
+	clock           clock
+	// ctx stops the background drains once Run returns
+	ctx context.Context
+
+	advertised bool
+	// shuttingDown is whether the graceful shutdown of the path was announced
+	// and waited for, so that a retried withdrawal does not wait again
+	shuttingDown bool
+	// checkFailing is whether the last healthcheck failed, so that failures
+	// are notified once
+	checkFailing bool
+	// retries counts the consecutive failed transitions, which are not
+	// attempted again before retryAfter
+	retries    int
+	retryAfter time.Time
+}
+
+func NewServiceController(config *config, check Checker, adv advertiser, destinations *destinationPool, device *serviceDevice, bindOnAdvertise bool, clock clock) *ServiceController {
+	return &ServiceController{
+		config:          config,
+		check:           check,
+		advertiser:      adv,
+		destinations:    destinations,
+		device:          device,
+		bindOnAdvertise: bindOnAdvertise && device != nil,
+		clock:           clock,
+		ctx:             context.Background(),
+	}
+}
+
+// Advertised returns whether the service path is advertised
+func (c *ServiceController) Advertised() bool {
+	return c.advertised
+}
+
+// Run checks the service every interval until the context is done
+func (c *ServiceController) Run(ctx context.Context, interval time.Duration) {
+	c.ctx = ctx
+	for {
+		c.Step()
+		select {
+		case <-ctx.Done():
+			return
+		case <-c.clock.After(interval):
+		}
+	}
+}
+
+// Step checks the service once and advertises or withdraws the path if its
+// health changed, unless a failed transition is waiting to be retried
+func (c *ServiceController) Step() {
+	healthy, reason := c.healthy()
+	switch {
+	case healthy == c.advertised:
+		// A failed transition is no longer needed
+		c.backoff(nil)
+	case !c.clock.Now().Before(c.retryAfter):
+		var err error
+		if healthy {
+			err = c.advertise()
+		} else {
+			err = c.withdraw(c.ctx, reason)
+		}
+		c.backoff(err)
+	}
+	if c.advertised {
+		verifyAdvertisement(c.advertiser, c.config, c.advertised)
+	}
+}
+
+// healthy runs the service healthcheck and checks that the real servers and
+// the host can serve the traffic. It returns the reason of the result.
+func (c *ServiceController) healthy() (bool, string) {
+	log.Debug("Running a new healthcheck")
+	check := checkType(c.check)
+	start := c.clock.Now()
+	res := c.check.Check()
+	observeHealthCheckMetrics(c.config.Service.Name, check, res, c.clock.Now().Sub(start))
+	// The warnings of a persistently unhealthy service are repeated only once
+	// in a while, and right away once it recovered
+	if res.err != "" {
+		repeatedLogs.Warn("healthcheck_error", log.WithFields(log.Fields{
+			"check": check,
+			"error": res.err,
+		}), "Healthcheck error")
+	} else {
+		repeatedLogs.Reset("healthcheck_error")
+	}
+	healthy, reason := true, reasonHealthy
+	if res.healthy {
+		log.WithFields(log.Fields{"check": check}).Debug("Healthcheck succeeded")
+		repeatedLogs.Reset("healthcheck")
+	} else {
+		fields := log.Fields{"check": check}
+		if res.output != "" {
+			fields["output"] = res.output
+		}
+		repeatedLogs.Warn("healthcheck", log.WithFields(fields), "Healthcheck failed")
+		healthy, reason = false, reasonHealthCheckFailed
+		if !c.checkFailing {
+			notifications.Notify(event{
+				Type:   eventCheckFailed,
+				Time:   c.clock.Now(),
+				Check:  check,
+				Error:  res.err,
+				Output: res.output,
+			})
+		}
+	}
+	c.checkFailing = !res.healthy
+	// With real servers configured, the service is healthy as long as any
+	// destination, checked or not, can serve traffic. They are checked
+	// regardless, to keep their weights up to date.
+	if c.destinations.HealthChecked() > 0 && c.destinations.Check() == 0 {
+		repeatedLogs.Warn("destinations", log.NewEntry(log.StandardLogger()), "No healthy ipvs destination left")
+		if healthy {
+			healthy, reason = false, reasonNoHealthyDestinations
+		}
+	} else {
+		repeatedLogs.Reset("destinations")
+	}
+	// The host cannot answer for the service ip without the address
+	if c.device != nil && !c.device.Ready() {
+		repeatedLogs.Warn("device", log.NewEntry(log.StandardLogger()), "Service address is not configured on the host")
+		if healthy {
+			healthy, reason = false, reasonAddressNotReady
+		}
+	} else {
+		repeatedLogs.Reset("device")
+	}
+	return healthy, reason
+}
+
+// backoff schedules the retry of a failed transition, doubling the interval
+// on every consecutive failure
+func (c *ServiceController) backoff(err error) {
+	if err == nil {
+		c.retries = 0
+		c.retryAfter = time.Time{}
+		return
+	}
+	wait := min(minBGPRetryInterval<<c.retries, maxBGPRetryInterval)
+	c.retries++
+	c.retryAfter = c.clock.Now().Add(wait)
+	log.WithFields(log.Fields{
+		"error":    err,
+		"retries":  c.retries,
+		"retry_in": wait,
+	}).Error("Cannot change the service advertisement, retrying")
+}
+
+// advertise stops draining, binds the service on the host, if needed, and
+// announces the path
+func (c *ServiceController) advertise() error {
+	// Stopping the drain first ensures that it does not unbind the service
+	// once bound
+	c.destinations.Undrain()
+	if c.bindOnAdvertise {
+		if err := bindService(c.destinations, c.device); err != nil {
+			unbindService(c.destinations, c.device)
+			return fmt.Errorf("cannot bind the service on the host: %v", err)
+		}
+	}
+	if err := c.advertiser.AddV4Path(
+		c.config.Service.IP,
+		c.config.Service.PrefixLength,
+		c.config.Bgp.Local.RouterId,
+	); err != nil {
+		// The host must not answer for the service ip while it is not
+		// advertised
+		if c.bindOnAdvertise {
+			unbindService(c.destinations, c.device)
+		}
+		return fmt.Errorf("cannot advertise the service path: %v", err)
+	}
+	c.advertiser.ListV4Paths()
+	c.advertised = true
+	setServiceTransitionMetrics(c.config.Service.Name, "advertise", reasonHealthy, c.clock.Now())
+	notifications.Notify(event{Type: eventAdvertise, Time: c.clock.Now(), Reason: reasonHealthy})
+	log.WithFields(log.Fields{
+		"transition": "advertise",
+		"reason":     reasonHealthy,
+	}).Info("Service on")
+	return nil
+}
+
+// withdraw withdraws the path for the given reason, after a graceful shutdown
+// if configured, and drains and unbinds the service on the host. The drain runs
+// in the background until done or the context is cancelled.
+func (c *ServiceController) withdraw(ctx context.Context, reason string) error {
+	if c.config.Bgp.GracefulShutdownSeconds > 0 && !c.shuttingDown {
+		c.gracefulShutdown()
+		c.shuttingDown = true
+	}
+	if err := c.advertiser.DeleteV4Path(
+		c.config.Service.IP,
+		c.config.Service.PrefixLength,
+		c.config.Bgp.Local.RouterId,
+	); err != nil {
+		return fmt.Errorf("cannot withdraw the service path: %v", err)
+	}
+	c.advertiser.ListV4Paths()
+	c.advertised = false
+	c.shuttingDown = false
+	setServiceTransitionMetrics(c.config.Service.Name, "withdraw", reason, c.clock.Now())
+	notifications.Notify(event{Type: eventWithdraw, Time: c.clock.Now(), Reason: reason})
+	verifyAdvertisement(c.advertiser, c.config, c.advertised)
+	var unbind func()
+	if c.bindOnAdvertise {
+		unbind = func() { unbindService(c.destinations, c.device) }
+	}
+	// Stop accepting the connections that still arrive while the routers
+	// converge and let the established ones finish before unbinding
+	if ipvs := c.config.Service.IPVS; ipvs != nil && ipvs.DrainTimeoutSeconds > 0 {
+		c.destinations.Drain(ctx, c.config.Service.Name, time.Duration(ipvs.DrainTimeoutSeconds)*time.Second, ipvs.DrainThreshold, c.clock, unbind)
+	} else if unbind != nil {
+		unbind()
+	}
+	log.WithFields(log.Fields{
+		"transition": "withdraw",
+		"reason":     reason,
+	}).Info("Service off")
+	return nil
+}
+
+// gracefulShutdown tags the advertised path with the GRACEFUL_SHUTDOWN
+// community and waits for the peers to move traffic away before it gets
+// withdrawn
+func (c *ServiceController) gracefulShutdown() {
+	wait := time.Duration(c.config.Bgp.GracefulShutdownSeconds) * time.Second
+	if err := c.advertiser.GracefulShutdownV4Path(
+		c.config.Service.IP,
+		c.config.Service.PrefixLength,
+		c.config.Bgp.Local.RouterId,
+	); err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Warn("Cannot announce graceful shutdown, withdrawing immediately")
+		return
+	}
+	log.WithFields(log.Fields{
+		"wait": wait,
+	}).Info("Graceful shutdown announced, waiting before withdrawing")
+	<-c.clock.After(wait)
+}
+
+// Shutdown withdraws the path before the process exits. When the process is
+// restarting and graceful restart is configured, the path is kept so that the
+// peers continue to forward traffic while the process restarts. It returns
+// whether the path was kept.
+func (c *ServiceController) Shutdown(restarting bool) bool {
+	if restarting && c.config.Bgp.GracefulRestart != nil {
+		log.Info("Restarting with graceful restart configured, keeping the advertised path")
+		return true
+	}
+	if !c.advertised {
+		return false
+	}
+	// The run context is done by now, the drain is waited for regardless
+	if err := c.withdraw(context.Background(), reasonShutdown); err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Error("Cannot withdraw the service path on shutdown")
+	}
+	c.destinations.WaitDrain()
+	return false
+}
+
+// bindService adds the service address and ipvs services on the host
+func bindService(destinations *destinationPool, device *serviceDevice) error {
+	if err := device.Bind(); err != nil {
+		return err
+	}
+	return destinations.Activate()
+}
+
+// unbindService deletes the ipvs services and service address from the host
+func unbindService(destinations *destinationPool, device *serviceDevice) {
+	if err := destinations.Deactivate(); err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Warn("Cannot delete ipvs services")
+	}
+	if err := device.Unbind(); err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Warn("Cannot delete the service address")
+	}
+}
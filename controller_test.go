@@ -0,0 +1,392 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeClock is a clock that only moves when advanced. Waiting on it advances
+// it by the waited duration.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.Advance(d)
+	ch := make(chan time.Time, 1)
+	ch <- c.Now()
+	return ch
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// fakeAdvertiser records the advertised paths and fails the calls while the
+// errors are set
+type fakeAdvertiser struct {
+	addErr, deleteErr error
+	paths             map[string]bool
+	gracefulShutdowns int
+}
+
+func (a *fakeAdvertiser) AddV4Path(prefix string, prefixLen int, nextHop string) error {
+	if a.addErr != nil {
+		return a.addErr
+	}
+	a.paths[prefix] = true
+	return nil
+}
+
+func (a *fakeAdvertiser) GracefulShutdownV4Path(prefix string, prefixLen int, nextHop string) error {
+	a.gracefulShutdowns++
+	return nil
+}
+
+func (a *fakeAdvertiser) DeleteV4Path(prefix string, prefixLen int, nextHop string) error {
+	if a.deleteErr != nil {
+		return a.deleteErr
+	}
+	delete(a.paths, prefix)
+	return nil
+}
+
+func (a *fakeAdvertiser) V4PathAdvertisements(prefix string, prefixLen int) (bool, map[string]bool, error) {
+	return a.paths[prefix], map[string]bool{}, nil
+}
+
+func (a *fakeAdvertiser) ListV4Paths() {}
+
+// fakeCheck returns the result set by the test
+type fakeCheck struct {
+	healthy bool
+}
+
+func (c *fakeCheck) Check() Result {
+	return Result{healthy: c.healthy}
+}
+
+func TestServiceControllerStep(t *testing.T) {
+	errBGP := errors.New("bgp error")
+	type step struct {
+		healthy    bool
+		addErr     error
+		deleteErr  error
+		advance    time.Duration
+		advertised bool
+	}
+	for _, tc := range []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name: "follows the health",
+			steps: []step{
+				{healthy: false, advertised: false},
+				{healthy: true, advertised: true},
+				{healthy: true, advertised: true},
+				{healthy: false, advertised: false},
+				{healthy: true, advertised: true},
+			},
+		},
+		{
+			name: "retries a failed advertisement with backoff",
+			steps: []step{
+				{healthy: true, addErr: errBGP, advertised: false},
+				// Not retried before the first backoff of a second
+				{healthy: true, advance: 500 * time.Millisecond, advertised: false},
+				{healthy: true, addErr: errBGP, advance: 500 * time.Millisecond, advertised: false},
+				// The backoff doubles
+				{healthy: true, advance: time.Second, advertised: false},
+				{healthy: true, advance: time.Second, advertised: true},
+			},
+		},
+		{
+			name: "keeps the path while the withdrawal fails",
+			steps: []step{
+				{healthy: true, advertised: true},
+				{healthy: false, deleteErr: errBGP, advertised: true},
+				{healthy: false, advance: time.Second, advertised: false},
+			},
+		},
+		{
+			name: "a recovered service does not wait for the backoff",
+			steps: []step{
+				{healthy: true, advertised: true},
+				{healthy: false, deleteErr: errBGP, advertised: true},
+				{healthy: true, advertised: true},
+				{healthy: false, advertised: false},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := &config{Service: serviceConfig{Name: "ingress", IP: "10.88.2.1", PrefixLength: 32}}
+			check := &fakeCheck{}
+			adv := &fakeAdvertiser{paths: map[string]bool{}}
+			clk := &fakeClock{now: time.Unix(0, 0)}
+			destinations := newDestinationPool(c.Service.IP, "", newFakeLoadBalancer())
+			controller := NewServiceController(c, check, adv, destinations, nil, false, clk)
+			for i, s := range tc.steps {
+				clk.Advance(s.advance)
+				check.healthy = s.healthy
+				adv.addErr, adv.deleteErr = s.addErr, s.deleteErr
+				controller.Step()
+				assert.Equal(t, s.advertised, controller.Advertised(), "step %d", i)
+				assert.Equal(t, s.advertised, adv.paths[c.Service.IP], "step %d", i)
+			}
+		})
+	}
+}
+
+func TestServiceControllerBackoff(t *testing.T) {
+	clk := &fakeClock{now: time.Unix(0, 0)}
+	controller := NewServiceController(&config{}, &fakeCheck{}, &fakeAdvertiser{}, nil, nil, false, clk)
+	var waits []time.Duration
+	for range 9 {
+		controller.backoff(errors.New("bgp error"))
+		waits = append(waits, controller.retryAfter.Sub(clk.Now()))
+	}
+	assert.Equal(t, []time.Duration{
+		time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 16 * time.Second,
+		32 * time.Second, time.Minute, time.Minute, time.Minute,
+	}, waits)
+	controller.backoff(nil)
+	assert.Equal(t, 0, controller.retries)
+	assert.True(t, controller.retryAfter.IsZero())
+}
+
+func TestServiceControllerGracefulShutdown(t *testing.T) {
+	c := &config{
+		Bgp:     bgpConfig{GracefulShutdownSeconds: 30},
+		Service: serviceConfig{Name: "ingress", IP: "10.88.2.1", PrefixLength: 32},
+	}
+	check := &fakeCheck{healthy: true}
+	adv := &fakeAdvertiser{paths: map[string]bool{}}
+	clk := &fakeClock{now: time.Unix(0, 0)}
+	destinations := newDestinationPool(c.Service.IP, "", newFakeLoadBalancer())
+	controller := NewServiceController(c, check, adv, destinations, nil, false, clk)
+	controller.Step()
+	assert.True(t, controller.Advertised())
+
+	// The path is withdrawn after waiting for the peers to move traffic away
+	assert.False(t, controller.Shutdown(false))
+	assert.False(t, controller.Advertised())
+	assert.Equal(t, 1, adv.gracefulShutdowns)
+	assert.Equal(t, time.Unix(30, 0), clk.Now())
+
+	// Graceful restart alone does not keep the path on a permanent stop
+	c.Bgp.GracefulRestart = &gracefulRestartConfig{}
+	controller.Step()
+	assert.False(t, controller.Shutdown(false))
+	assert.False(t, adv.paths[c.Service.IP])
+	assert.Equal(t, 2, adv.gracefulShutdowns)
+
+	// The path is kept when restarting
+	controller.Step()
+	assert.True(t, controller.Shutdown(true))
+	assert.True(t, adv.paths[c.Service.IP])
+	assert.Equal(t, 2, adv.gracefulShutdowns)
+}
+
+func TestServiceControllerTransitionMetrics(t *testing.T) {
+	c := &config{Service: serviceConfig{Name: "transitions-test", IP: "10.88.2.1", PrefixLength: 32}}
+	check := &fakeCheck{}
+	adv := &fakeAdvertiser{paths: map[string]bool{}}
+	clk := &fakeClock{now: time.Unix(100, 0)}
+	destinations := newDestinationPool(c.Service.IP, "", newFakeLoadBalancer())
+	controller := NewServiceController(c, check, adv, destinations, nil, false, clk)
+	transitions := func(transition, reason string) float64 {
+		return testutil.ToFloat64(serviceTransitions.WithLabelValues(c.Service.Name, transition, reason))
+	}
+
+	check.healthy = true
+	controller.Step()
+	clk.Advance(time.Minute)
+	check.healthy = false
+	controller.Step()
+	// Failed transitions are not counted
+	adv.addErr = errors.New("bgp error")
+	check.healthy = true
+	controller.Step()
+
+	assert.Equal(t, 1.0, transitions("advertise", reasonHealthy))
+	assert.Equal(t, 1.0, transitions("withdraw", reasonHealthCheckFailed))
+	assert.Equal(t, 160.0, testutil.ToFloat64(serviceLastTransition.WithLabelValues(c.Service.Name)))
+	assert.Equal(t, 2.0, testutil.ToFloat64(healthCheckResults.WithLabelValues(c.Service.Name, "other", "success")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(healthCheckResults.WithLabelValues(c.Service.Name, "other", "failure")))
+}
+
+func TestServiceControllerNotifications(t *testing.T) {
+	c := testWebhookConfig(webhookConfig{URL: "http://127.0.0.1/hook"})
+	check := &fakeCheck{}
+	adv := &fakeAdvertiser{paths: map[string]bool{}}
+	clk := &fakeClock{now: time.Unix(0, 0)}
+	var err error
+	notifications, err = newNotifier(c, clk)
+	require.NoError(t, err)
+	t.Cleanup(func() { notifications = nil })
+	destinations := newDestinationPool(c.Service.IP, "", newFakeLoadBalancer())
+	controller := NewServiceController(c, check, adv, destinations, nil, false, clk)
+
+	for _, healthy := range []bool{true, true, false, false, true} {
+		check.healthy = healthy
+		controller.Step()
+	}
+
+	// The check failure is notified once, before the withdrawal
+	queue := notifications.sinks[0].queue
+	var events []event
+	for len(queue) > 0 {
+		events = append(events, <-queue)
+	}
+	assert.Equal(t, []string{eventAdvertise, eventCheckFailed, eventWithdraw, eventAdvertise}, eventTypesOf(events))
+	assert.Equal(t, reasonHealthCheckFailed, events[2].Reason)
+	assert.Equal(t, "other", events[1].Check)
+}
+
+func TestServiceControllerDrain(t *testing.T) {
+	c := &config{Service: serviceConfig{
+		Name:         "ingress",
+		IP:           "10.88.2.1",
+		PrefixLength: 32,
+		IPVS:         &ipvsServiceConfig{DrainTimeoutSeconds: 3600},
+	}}
+	lb := newFakeLoadBalancer()
+	svc := toIPVSService(c.Service.IP, "tcp", 80, nil)
+	require.NoError(t, lb.AddService("", svc))
+	active := fakeDestination("10.88.0.10", 8080, 1)
+	active.ActiveConnections = 5
+	require.NoError(t, lb.AddDestination("", svc, &active))
+	destinations := newDestinationPool(c.Service.IP, "", lb)
+	destinations.AddService(svc)
+	destinations.Add(svc, toIPVSDestination("10.88.0.10", 8080, "", nil), nil)
+	weight := func() int {
+		return lb.Service("", "tcp:10.88.2.1:80").destinations[0].Weight
+	}
+	check := &fakeCheck{healthy: true}
+	adv := &fakeAdvertiser{paths: map[string]bool{}}
+	controller := NewServiceController(c, check, adv, destinations, nil, false, realClock{})
+	controller.Step()
+
+	// The withdrawal does not wait for the drain
+	check.healthy = false
+	controller.Step()
+	assert.False(t, controller.Advertised())
+	assert.Equal(t, 0, weight())
+
+	// A recovered service is advertised again right away, stopping the drain
+	check.healthy = true
+	controller.Step()
+	assert.True(t, controller.Advertised())
+	assert.Equal(t, 1, weight())
+}
+
+func TestServiceControllerRealServers(t *testing.T) {
+	c := &config{Service: serviceConfig{Name: "ingress", IP: "10.88.2.1", PrefixLength: 32}}
+	lb := newFakeLoadBalancer()
+	local := toIPVSService(c.Service.IP, "tcp", 80, nil)
+	remote := toIPVSService(c.Service.IP, "tcp", 443, nil)
+	destinations := newDestinationPool(c.Service.IP, "", lb)
+	destinations.AddService(local)
+	destinations.AddService(remote)
+	realServer := &fakeCheck{healthy: true}
+	destinations.Add(remote, toIPVSDestination("10.88.0.10", 8443, "", nil), realServer)
+	require.NoError(t, destinations.Reconcile())
+	adv := &fakeAdvertiser{paths: map[string]bool{}}
+	controller := NewServiceController(c, &fakeCheck{healthy: true}, adv, destinations, nil, false, &fakeClock{})
+	controller.Step()
+	assert.True(t, controller.Advertised())
+
+	// Without a healthy real server left the path is withdrawn
+	realServer.healthy = false
+	controller.Step()
+	assert.False(t, controller.Advertised())
+
+	// Unless a local target port still serves traffic
+	destinations.Add(local, toIPVSDestination("10.0.0.1", 8080, "", nil), nil)
+	controller.Step()
+	assert.True(t, controller.Advertised())
+}
+
+func TestServiceControllerBindOnAdvertiseFailure(t *testing.T) {
+	host, lb := newFakeHostNetwork(), newFakeLoadBalancer()
+	c := &config{Service: serviceConfig{
+		Name:         "ingress",
+		IP:           "10.88.2.1",
+		PrefixLength: 32,
+		Protocol:     "tcp",
+		Ports:        []servicePortConfig{{ServicePort: 80}},
+	}}
+	destinations := netlinkSetup(host, lb, c.Service, "10.88.0.10", true, true)
+	device := newServiceDevice(c.Service, false, host)
+	check := &fakeCheck{healthy: true}
+	adv := &fakeAdvertiser{paths: map[string]bool{}, addErr: errors.New("bgp error")}
+	clk := &fakeClock{now: time.Unix(0, 0)}
+	controller := NewServiceController(c, check, adv, destinations, device, true, clk)
+
+	// A failed advertisement leaves the service unbound, even if the service
+	// turns unhealthy before the retry
+	controller.Step()
+	assert.False(t, controller.Advertised())
+	present, err := host.HasAddress("", c.Service.IP, "ingress")
+	assert.NoError(t, err)
+	assert.False(t, present)
+	assert.Nil(t, lb.Service("", "tcp:10.88.2.1:80"))
+
+	// Bound once advertised
+	adv.addErr = nil
+	clk.Advance(time.Second)
+	controller.Step()
+	assert.True(t, controller.Advertised())
+	present, err = host.HasAddress("", c.Service.IP, "ingress")
+	assert.NoError(t, err)
+	assert.True(t, present)
+	assert.NotNil(t, lb.Service("", "tcp:10.88.2.1:80"))
+}
+
+func TestServiceControllerGracefulShutdownRetry(t *testing.T) {
+	c := &config{
+		Bgp:     bgpConfig{GracefulShutdownSeconds: 30},
+		Service: serviceConfig{Name: "ingress", IP: "10.88.2.1", PrefixLength: 32},
+	}
+	check := &fakeCheck{healthy: true}
+	adv := &fakeAdvertiser{paths: map[string]bool{}}
+	clk := &fakeClock{now: time.Unix(0, 0)}
+	destinations := newDestinationPool(c.Service.IP, "", newFakeLoadBalancer())
+	controller := NewServiceController(c, check, adv, destinations, nil, false, clk)
+	controller.Step()
+
+	// The graceful shutdown is announced and waited for once across retries
+	check.healthy = false
+	adv.deleteErr = errors.New("bgp error")
+	controller.Step()
+	assert.True(t, controller.Advertised())
+	adv.deleteErr = nil
+	clk.Advance(time.Second)
+	controller.Step()
+	assert.False(t, controller.Advertised())
+	assert.Equal(t, 1, adv.gracefulShutdowns)
+	assert.Equal(t, time.Unix(31, 0), clk.Now())
+
+	// And again on the next withdrawal
+	check.healthy = true
+	controller.Step()
+	check.healthy = false
+	controller.Step()
+	assert.Equal(t, 2, adv.gracefulShutdowns)
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	libipvs "github.com/moby/ipvs"
+	log "github.com/sirupsen/logrus"
+)
+
+// destination is an ipvs real server under a service. Destinations without a
+// healthcheck are always considered healthy.
+type destination struct {
+	service *libipvs.Service
+	dest    *libipvs.Destination
+	check   Checker
+	healthy bool
+}
+
+// weight returns the weight the destination should have based on its health
+func (d *destination) weight() int {
+	if d.healthy {
+		return d.dest.Weight
+	}
+	return 0
+}
+
+// destinationPool holds the desired ipvs services of the service ip and their
+// health checked real servers
+type destinationPool struct {
+	ip    string
+	netns string
+	lb    LoadBalancer
+
+	mu           sync.Mutex
+	services     []*libipvs.Service
+	destinations []*destination
+	// draining sets the weight of all the destinations to 0
+	draining bool
+	// inactive pools keep their ipvs services deleted
+	inactive bool
+	// cancelDrain stops the running drain, which closes drained once stopped
+	cancelDrain context.CancelFunc
+	drained     chan struct{}
+}
+
+func newDestinationPool(ip, netns string, lb LoadBalancer) *destinationPool {
+	return &destinationPool{ip: ip, netns: netns, lb: lb}
+}
+
+// weight returns the weight a destination should have based on its health and
+// whether the pool is draining
+func (dp *destinationPool) weight(d *destination) int {
+	if dp.draining {
+		return 0
+	}
+	return d.weight()
+}
+
+// AddService adds an ipvs service to the desired state
+func (dp *destinationPool) AddService(svc *libipvs.Service) {
+	dp.mu.Lock()
+	defer dp.mu.Unlock()
+	dp.services = append(dp.services, svc)
+}
+
+// Add adds a real server under a service, which is considered healthy until
+// checked. A nil check means that the real server is not health checked.
+func (dp *destinationPool) Add(svc *libipvs.Service, dest *libipvs.Destination, check Checker) {
+	dp.mu.Lock()
+	defer dp.mu.Unlock()
+	dp.destinations = append(dp.destinations, &destination{
+		service: svc,
+		dest:    dest,
+		check:   check,
+		healthy: true,
+	})
+}
+
+// Check runs all the real server healthchecks concurrently, sets the weight of
+// the unhealthy ones to 0 and restores it for the healthy ones. It returns the
+// number of destinations serving traffic, which are the healthy real servers
+// and the destinations without a healthcheck. Shared checks run once for all
+// their real servers.
+func (dp *destinationPool) Check() int {
+	checked := dp.checked()
+	var checks []Checker
+	// index maps the checked destinations to their check
+	index := make([]int, len(checked))
+	shared := map[*sharedCheck]int{}
+	for i, d := range checked {
+		s, ok := d.check.(*sharedCheck)
+		if ok {
+			if j, seen := shared[s]; seen {
+				index[i] = j
+				continue
+			}
+			shared[s] = len(checks)
+		}
+		index[i] = len(checks)
+		checks = append(checks, d.check)
+	}
+	var wg sync.WaitGroup
+	checkResults := make([]Result, len(checks))
+	for i, check := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			checkResults[i] = check.Check()
+		}()
+	}
+	wg.Wait()
+	results := make([]Result, len(checked))
+	for i := range checked {
+		results[i] = checkResults[index[i]]
+	}
+
+	dp.mu.Lock()
+	defer dp.mu.Unlock()
+	healthy := len(dp.destinations) - len(checked)
+	for i, d := range checked {
+		res := results[i]
+		if res.healthy {
+			healthy++
+		}
+		if res.healthy == d.healthy {
+			continue
+		}
+		fields := log.Fields{
+			"ipvs_service": ipvsServiceKey(d.service),
+			"destination":  ipvsDestinationKey(d.dest),
+		}
+		if !res.healthy {
+			fields["error"] = res.err
+			fields["output"] = res.output
+		}
+		d.healthy = res.healthy
+		if dp.inactive {
+			continue
+		}
+		if err := updateIPVSDestinationWeight(dp.lb, dp.netns, d.service, d.dest, dp.weight(d)); err != nil {
+			fields["error"] = err
+			log.WithFields(fields).Error("Cannot update ipvs destination weight, leaving it to reconciliation")
+			continue
+		}
+		if res.healthy {
+			log.WithFields(fields).Info("IPVS destination healthy, restored weight")
+		} else {
+			log.WithFields(fields).Warn("IPVS destination unhealthy, set weight to 0")
+		}
+	}
+	return healthy
+}
+
+// checked returns the health checked destinations
+func (dp *destinationPool) checked() []*destination {
+	dp.mu.Lock()
+	defer dp.mu.Unlock()
+	var checked []*destination
+	for _, d := range dp.destinations {
+		if d.check != nil {
+			checked = append(checked, d)
+		}
+	}
+	return checked
+}
+
+// HealthChecked returns the number of health checked real servers in the pool
+func (dp *destinationPool) HealthChecked() int {
+	return len(dp.checked())
+}
+
+// Reconcile makes the ipvs services of the service ip match the desired state
+func (dp *destinationPool) Reconcile() error {
+	dp.mu.Lock()
+	defer dp.mu.Unlock()
+	if dp.inactive {
+		return nil
+	}
+	desired := make([]ipvsServiceState, 0, len(dp.services))
+	for _, svc := range dp.services {
+		state := ipvsServiceState{service: svc}
+		for _, d := range dp.destinations {
+			if d.service != svc {
+				continue
+			}
+			dest := *d.dest
+			dest.Weight = dp.weight(d)
+			state.destinations = append(state.destinations, &dest)
+		}
+		desired = append(desired, state)
+	}
+	if err := reconcileIPVSServices(dp.lb, dp.netns, dp.ip, desired); err != nil {
+		return err
+	}
+	hostRecord.RecordIPVSServices(dp.netns, dp.services)
+	return nil
+}
+
+// Activate creates the ipvs services of the pool
+func (dp *destinationPool) Activate() error {
+	dp.mu.Lock()
+	dp.inactive = false
+	dp.mu.Unlock()
+	return dp.Reconcile()
+}
+
+// Deactivate deletes the ipvs services of the pool and keeps them deleted
+// until activated
+func (dp *destinationPool) Deactivate() error {
+	dp.mu.Lock()
+	defer dp.mu.Unlock()
+	dp.inactive = true
+	for _, svc := range dp.services {
+		if err := dp.lb.DeleteService(dp.netns, svc); err != nil {
+			return fmt.Errorf("Cannot delete ipvs service %s: %v", ipvsServiceKey(svc), err)
+		}
+	}
+	hostRecord.ForgetIPVSServices(dp.netns, dp.services)
+	return nil
+}
+
+// Drain sets the weight of all the destinations to 0, so that ipvs stops
+// scheduling new connections, and waits in the background until the active
+// connections drop to the threshold or the timeout expires, then calls done, if
+// set.
+// The wait stops without calling done when the context is cancelled or on
+// Undrain, which restores the weights.
+func (dp *destinationPool) Drain(ctx context.Context, name string, timeout time.Duration, threshold int, clock clock, done func()) {
+	dp.stopDrain()
+	dp.mu.Lock()
+	dp.draining = true
+	services := slices.Clone(dp.services)
+	dp.mu.Unlock()
+	if len(services) == 0 {
+		if done != nil {
+			done()
+		}
+		return
+	}
+	dp.updateWeights()
+	ctx, cancel := context.WithCancel(ctx)
+	drained := make(chan struct{})
+	dp.mu.Lock()
+	dp.cancelDrain, dp.drained = cancel, drained
+	dp.mu.Unlock()
+	go func() {
+		defer close(drained)
+		if dp.waitDrained(ctx, name, services, timeout, threshold, clock) && done != nil {
+			done()
+		}
+	}()
+}
+
+// waitDrained polls the active connections of the services until they drop
+// to the threshold or the timeout expires. It returns false if the context
+// was cancelled first.
+func (dp *destinationPool) waitDrained(ctx context.Context, name string, services []*libipvs.Service, timeout time.Duration, threshold int, clock clock) bool {
+	setIPVSDrainingMetric(name, true)
+	defer setIPVSDrainingMetric(name, false)
+	deadline := clock.Now().Add(timeout)
+	for {
+		active, err := activeIPVSConnections(dp.lb, dp.netns, services)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+			}).Warn("Cannot get ipvs active connections, stopping drain")
+			return true
+		}
+		setIPVSDrainActiveConnectionsMetric(name, active)
+		if active <= threshold {
+			log.WithFields(log.Fields{
+				"active_connections": active,
+			}).Info("IPVS destinations drained")
+			return true
+		}
+		remaining := deadline.Sub(clock.Now())
+		if remaining <= 0 {
+			log.WithFields(log.Fields{
+				"active_connections": active,
+			}).Warn("IPVS drain timed out with active connections left")
+			return true
+		}
+		log.WithFields(log.Fields{
+			"active_connections": active,
+			"remaining":          remaining.Round(time.Second),
+		}).Info("Draining ipvs destinations")
+		select {
+		case <-ctx.Done():
+			log.Info("IPVS drain stopped")
+			return false
+		case <-clock.After(ipvsDrainInterval):
+		}
+	}
+}
+
+// WaitDrain waits for the running drain, if any, to finish
+func (dp *destinationPool) WaitDrain() {
+	dp.mu.Lock()
+	drained := dp.drained
+	dp.mu.Unlock()
+	if drained != nil {
+		<-drained
+	}
+}
+
+// stopDrain stops the running drain, if any, and waits for it
+func (dp *destinationPool) stopDrain() {
+	dp.mu.Lock()
+	cancel, drained := dp.cancelDrain, dp.drained
+	dp.cancelDrain, dp.drained = nil, nil
+	dp.mu.Unlock()
+	if cancel != nil {
+		cancel()
+		<-drained
+	}
+}
+
+// Undrain stops a running drain and restores the weight of the destinations
+func (dp *destinationPool) Undrain() {
+	dp.stopDrain()
+	dp.mu.Lock()
+	draining := dp.draining
+	dp.draining = false
+	dp.mu.Unlock()
+	if draining {
+		dp.updateWeights()
+	}
+}
+
+// updateWeights sets the weight of all the destinations in ipvs, leaving any
+// failure to the reconciliation
+func (dp *destinationPool) updateWeights() {
+	dp.mu.Lock()
+	defer dp.mu.Unlock()
+	if dp.inactive {
+		return
+	}
+	for _, d := range dp.destinations {
+		if err := updateIPVSDestinationWeight(dp.lb, dp.netns, d.service, d.dest, dp.weight(d)); err != nil {
+			log.WithFields(log.Fields{
+				"ipvs_service": ipvsServiceKey(d.service),
+				"destination":  ipvsDestinationKey(d.dest),
+				"error":        err,
+			}).Warn("Cannot update ipvs destination weight, leaving it to reconciliation")
+		}
+	}
+}
+
+// WatchStats periodically exports the traffic stats of the ipvs services and
+// their destinations as metrics
+func (dp *destinationPool) WatchStats(name string, interval time.Duration) {
+	for t := time.Tick(interval); ; <-t {
+		dp.mu.Lock()
+		services := slices.Clone(dp.services)
+		dp.mu.Unlock()
+		stats, err := getIPVSStats(dp.lb, dp.netns, services)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+			}).Warn("Cannot get ipvs stats")
+			continue
+		}
+		setIPVSStatsMetrics(name, dp.ip, stats)
+	}
+}
+
+// WatchReconcile periodically reconciles the ipvs services to repair any drift
+// caused by other tools or manual changes
+func (dp *destinationPool) WatchReconcile(interval time.Duration) {
+	for t := time.Tick(interval); ; <-t {
+		if err := dp.Reconcile(); err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+			}).Warn("Cannot reconcile ipvs services")
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	libipvs "github.com/moby/ipvs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDestinationPoolWeight(t *testing.T) {
+	dp := newDestinationPool("10.88.2.1", "", nil)
+	weight := 5
+	d := &destination{dest: toIPVSDestination("10.88.0.200", 8080, "", &weight), healthy: true}
+	assert.Equal(t, 5, dp.weight(d))
+
+	d.healthy = false
+	assert.Equal(t, 0, dp.weight(d))
+
+	d.healthy = true
+	dp.draining = true
+	assert.Equal(t, 0, dp.weight(d))
+}
+
+func TestDestinationPoolDrainWithoutServices(t *testing.T) {
+	dp := newDestinationPool("10.88.2.1", "", nil)
+	done := false
+	dp.Drain(context.Background(), "test", time.Minute, 0, realClock{}, func() { done = true })
+	assert.True(t, dp.draining)
+	assert.True(t, done)
+	dp.Undrain()
+	assert.False(t, dp.draining)
+}
+
+func TestDestinationPoolDrain(t *testing.T) {
+	lb := newFakeLoadBalancer()
+	svc := toIPVSService("10.88.2.1", "tcp", 80, nil)
+	require.NoError(t, lb.AddService("", svc))
+	active := fakeDestination("10.88.0.10", 8080, 1)
+	active.ActiveConnections = 5
+	require.NoError(t, lb.AddDestination("", svc, &active))
+	dp := newDestinationPool("10.88.2.1", "", lb)
+	dp.AddService(svc)
+	dp.Add(svc, toIPVSDestination("10.88.0.10", 8080, "", nil), nil)
+	var done atomic.Bool
+	undrained := func() bool {
+		return lb.Service("", "tcp:10.88.2.1:80").destinations[0].Weight == 1
+	}
+
+	// The drain times out in the background, then calls done
+	clk := &fakeClock{now: time.Unix(0, 0)}
+	dp.Drain(context.Background(), "test", time.Minute, 0, clk, func() { done.Store(true) })
+	assert.False(t, undrained())
+	dp.WaitDrain()
+	assert.True(t, done.Load())
+	assert.Equal(t, time.Unix(60, 0), clk.Now())
+
+	// Undrain stops a running drain without calling done
+	done.Store(false)
+	dp.Drain(context.Background(), "test", time.Hour, 0, realClock{}, func() { done.Store(true) })
+	dp.Undrain()
+	assert.False(t, done.Load())
+	assert.True(t, undrained())
+
+	// So does cancelling the context
+	ctx, cancel := context.WithCancel(context.Background())
+	dp.Drain(ctx, "test", time.Hour, 0, realClock{}, func() { done.Store(true) })
+	cancel()
+	dp.WaitDrain()
+	assert.False(t, done.Load())
+}
+
+func TestDestinationPoolDeactivate(t *testing.T) {
+	dp := newDestinationPool("10.88.2.1", "", nil)
+	assert.NoError(t, dp.Deactivate())
+	assert.True(t, dp.inactive)
+	// Inactive pools are not reconciled
+	assert.NoError(t, dp.Reconcile())
+}
+
+func TestDestinationPoolReconcile(t *testing.T) {
+	lb := newFakeLoadBalancer()
+	useHostRecord(t, newFakeHostNetwork(), lb)
+	svc := toIPVSService("10.88.2.1", "tcp", 80, nil)
+	// Drift: a stale service of the ip, a changed weight and a stale
+	// destination. Services of other ips are left alone.
+	assert.NoError(t, lb.AddService("", toIPVSService("10.88.2.1", "tcp", 443, nil)))
+	hostRecord.RecordIPVSServices("", []*libipvs.Service{toIPVSService("10.88.2.1", "tcp", 443, nil)})
+	assert.NoError(t, lb.AddService("", toIPVSService("10.88.2.2", "tcp", 80, nil)))
+	assert.NoError(t, lb.AddService("", svc))
+	stale := fakeDestination("10.88.0.99", 8080, 1)
+	changed := fakeDestination("10.88.0.10", 8080, 3)
+	assert.NoError(t, lb.AddDestination("", svc, &stale))
+	assert.NoError(t, lb.AddDestination("", svc, &changed))
+
+	dp := newDestinationPool("10.88.2.1", "", lb)
+	dp.AddService(svc)
+	dp.Add(svc, toIPVSDestination("10.88.0.10", 8080, "", nil), nil)
+	dp.Add(svc, toIPVSDestination("10.88.0.11", 8080, "", nil), nil)
+	assert.NoError(t, dp.Reconcile())
+	assert.Nil(t, lb.Service("", "tcp:10.88.2.1:443"))
+	assert.NotNil(t, lb.Service("", "tcp:10.88.2.2:80"))
+	// The deleted stale service is no longer recorded
+	assert.Equal(t, []ipvsServiceRecord{toIPVSServiceRecord("", svc)}, hostRecord.IPVSServices)
+	assert.ElementsMatch(t, []libipvs.Destination{
+		fakeDestination("10.88.0.10", 8080, 1),
+		fakeDestination("10.88.0.11", 8080, 1),
+	}, lb.Service("", "tcp:10.88.2.1:80").destinations)
+
+	// Draining sets the weights to 0 without a reconciliation
+	dp.mu.Lock()
+	dp.draining = true
+	dp.mu.Unlock()
+	dp.updateWeights()
+	for _, d := range lb.Service("", "tcp:10.88.2.1:80").destinations {
+		assert.Equal(t, 0, d.Weight)
+	}
+	dp.Undrain()
+	for _, d := range lb.Service("", "tcp:10.88.2.1:80").destinations {
+		assert.Equal(t, 1, d.Weight)
+	}
+
+	assert.NoError(t, dp.Deactivate())
+	assert.Nil(t, lb.Service("", "tcp:10.88.2.1:80"))
+	assert.NoError(t, dp.Activate())
+	assert.NotNil(t, lb.Service("", "tcp:10.88.2.1:80"))
+}
+
+// countingCheck counts its runs
+type countingCheck struct {
+	runs atomic.Int32
+}
+
+func (c *countingCheck) Check() Result {
+	c.runs.Add(1)
+	return Result{healthy: true}
+}
+
+func TestDestinationPoolSharedChecks(t *testing.T) {
+	checks := realServerChecks{}
+	hc := &httpHealthCheckConfig{Port: 8080}
+	a := checks.Setup(realServerConfig{Address: "10.88.0.10", Port: 30000, HttpHealthCheck: hc})
+	assert.Same(t, a, checks.Setup(realServerConfig{Address: "10.88.0.10", Port: 30001, HttpHealthCheck: hc}))
+	assert.NotSame(t, a, checks.Setup(realServerConfig{Address: "10.88.0.11", Port: 30000, HttpHealthCheck: hc}))
+	assert.NotSame(t, a, checks.Setup(realServerConfig{Address: "10.88.0.10", Port: 30000}))
+
+	// A shared check runs once for all the ports of its real server
+	lb := newFakeLoadBalancer()
+	dp := newDestinationPool("10.88.2.1", "", lb)
+	shared, own := &countingCheck{}, &countingCheck{}
+	check := &sharedCheck{shared}
+	for port := uint16(30000); port < 30003; port++ {
+		svc := toIPVSService("10.88.2.1", "tcp", port, nil)
+		dp.AddService(svc)
+		dp.Add(svc, toIPVSDestination("10.88.0.10", port, "", nil), check)
+		dp.Add(svc, toIPVSDestination("10.88.0.11", port, "", nil), own)
+	}
+	// Destinations without a healthcheck serve traffic as well
+	dp.Add(dp.services[0], toIPVSDestination("10.0.0.1", 8080, "", nil), nil)
+	assert.Equal(t, 7, dp.Check())
+	assert.Equal(t, int32(1), shared.runs.Load())
+	assert.Equal(t, int32(3), own.runs.Load())
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+)
+
+// serviceDevice watches the service device and address on the host and
+// restores them when they get deleted
+type serviceDevice struct {
+	host         HostNetwork
+	netns        string
+	vrf          string
+	name         string
+	create       bool
+	ip           string
+	prefixLength int
+
+	mu sync.Mutex
+	// bound is set while the service address should be configured
+	bound bool
+	// ready is set while the service address is configured on the host, or
+	// is not needed
+	ready atomic.Bool
+}
+
+func newServiceDevice(serviceConfig serviceConfig, bound bool, host HostNetwork) *serviceDevice {
+	d := &serviceDevice{
+		host:         host,
+		netns:        serviceConfig.Netns,
+		vrf:          serviceConfig.VRF,
+		name:         serviceDeviceName(serviceConfig),
+		create:       serviceConfig.Device == "",
+		ip:           serviceConfig.IP,
+		prefixLength: serviceConfig.PrefixLength,
+		bound:        bound,
+	}
+	d.ready.Store(true)
+	return d
+}
+
+// Ready returns whether the host can serve the service address
+func (d *serviceDevice) Ready() bool {
+	return d.ready.Load()
+}
+
+// Bind adds the service address to the device and keeps it there
+func (d *serviceDevice) Bind() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.bound = true
+	if err := d.ensureDevice(); err != nil {
+		d.ready.Store(false)
+		return err
+	}
+	if err := addServiceAddress(d.host, d.netns, d.ip, d.name, d.prefixLength); err != nil {
+		d.ready.Store(false)
+		return err
+	}
+	d.ready.Store(true)
+	return nil
+}
+
+// Unbind deletes the service address from the device and keeps it deleted
+func (d *serviceDevice) Unbind() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.bound = false
+	d.ready.Store(true)
+	if err := d.host.DeleteAddress(d.netns, d.ip, d.name, d.prefixLength); err != nil {
+		return err
+	}
+	hostRecord.ForgetAddress(d.netns, d.name, d.ip, d.prefixLength)
+	return nil
+}
+
+// Release stops keeping the service address on the device, leaving it as is
+func (d *serviceDevice) Release() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.bound = false
+}
+
+// Watch reconciles the service device and address on every link or address
+// update from netlink and periodically, in case the updates are missed
+func (d *serviceDevice) Watch(interval time.Duration) {
+	links := make(chan netlink.LinkUpdate)
+	addrs := make(chan netlink.AddrUpdate)
+	if err := subscribeNetlinkUpdates(d.netns, links, addrs); err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Warn("Cannot subscribe to netlink updates, polling only")
+	}
+	t := time.Tick(interval)
+	for {
+		select {
+		case u, ok := <-links:
+			if !ok {
+				links = nil
+				continue
+			}
+			if u.Attrs().Name != d.name {
+				continue
+			}
+		case u, ok := <-addrs:
+			if !ok {
+				addrs = nil
+				continue
+			}
+			if u.NewAddr || !u.LinkAddress.IP.Equal(net.ParseIP(d.ip)) {
+				continue
+			}
+		case <-t:
+		}
+		d.Reconcile()
+	}
+}
+
+// subscribeNetlinkUpdates subscribes to the link and address updates of the
+// network namespace at the given path, or of the current one if empty
+func subscribeNetlinkUpdates(path string, links chan netlink.LinkUpdate, addrs chan netlink.AddrUpdate) error {
+	ns, err := getNetns(path)
+	if err != nil {
+		return err
+	}
+	defer ns.Close()
+	if err := netlink.LinkSubscribeAt(ns, links, nil); err != nil {
+		return fmt.Errorf("cannot subscribe to link updates: %v", err)
+	}
+	if err := netlink.AddrSubscribeAt(ns, addrs, nil); err != nil {
+		return fmt.Errorf("cannot subscribe to address updates: %v", err)
+	}
+	return nil
+}
+
+// ensureDevice creates the device if needed and sets its vrf
+func (d *serviceDevice) ensureDevice() error {
+	if err := ensureServiceDevice(d.host, d.netns, d.name, d.create); err != nil {
+		return err
+	}
+	if d.vrf != "" {
+		return d.host.SetDeviceVRF(d.netns, d.name, d.vrf)
+	}
+	return nil
+}
+
+// Reconcile re-creates the service device and address if missing. The device
+// is not ready while the address cannot be restored.
+func (d *serviceDevice) Reconcile() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.bound {
+		return
+	}
+	present, err := d.host.HasAddress(d.netns, d.ip, d.name)
+	if err == nil && present {
+		d.ready.Store(true)
+		return
+	}
+	log.WithFields(log.Fields{
+		"device":  d.name,
+		"address": d.ip,
+		"error":   err,
+	}).Warn("Service address not found on the host, restoring it")
+	d.ready.Store(false)
+	if err := d.ensureDevice(); err != nil {
+		log.WithFields(log.Fields{
+			"device": d.name,
+			"error":  err,
+		}).Error("Cannot restore service link device")
+		return
+	}
+	if err := addServiceAddress(d.host, d.netns, d.ip, d.name, d.prefixLength); err != nil {
+		log.WithFields(log.Fields{
+			"device":  d.name,
+			"address": d.ip,
+			"error":   err,
+		}).Error("Cannot restore service address")
+		return
+	}
+	d.ready.Store(true)
+	log.WithFields(log.Fields{
+		"device":  d.name,
+		"address": d.ip,
+	}).Info("Restored service address")
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+
+	libipvs "github.com/moby/ipvs"
+)
+
+// fakeLink is a link of the fake host network
+type fakeLink struct {
+	kind  string
+	vrf   string
+	addrs []fakeAddr
+}
+
+type fakeAddr struct {
+	ip           string
+	prefixLength int
+	label        string
+}
+
+type fakeLinkKey struct {
+	netns string
+	name  string
+}
+
+// fakeHostNetwork is an in-memory HostNetwork
+type fakeHostNetwork struct {
+	mu    sync.Mutex
+	links map[fakeLinkKey]*fakeLink
+}
+
+func newFakeHostNetwork() *fakeHostNetwork {
+	return &fakeHostNetwork{links: map[fakeLinkKey]*fakeLink{}}
+}
+
+// AddLink adds a pre-existing link of the given kind
+func (f *fakeHostNetwork) AddLink(netns, name, kind string, addrs ...fakeAddr) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.links[fakeLinkKey{netns, name}] = &fakeLink{kind: kind, addrs: addrs}
+}
+
+// Link returns a link, or nil if it does not exist
+func (f *fakeHostNetwork) Link(netns, name string) *fakeLink {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.links[fakeLinkKey{netns, name}]
+}
+
+func (f *fakeHostNetwork) link(netns, name string) (*fakeLink, error) {
+	l, ok := f.links[fakeLinkKey{netns, name}]
+	if !ok {
+		return nil, fmt.Errorf("link %s not found", name)
+	}
+	return l, nil
+}
+
+func (f *fakeHostNetwork) EnsureDevice(netns, name string, create bool) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, err := f.link(netns, name); err == nil {
+		return false, nil
+	} else if !create {
+		return false, err
+	}
+	f.links[fakeLinkKey{netns, name}] = &fakeLink{kind: "dummy"}
+	return true, nil
+}
+
+func (f *fakeHostNetwork) DeleteDevice(netns, name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	l, err := f.link(netns, name)
+	if err != nil {
+		return nil
+	}
+	if l.kind != "dummy" {
+		return fmt.Errorf("refusing to delete %s link %s", l.kind, name)
+	}
+	delete(f.links, fakeLinkKey{netns, name})
+	return nil
+}
+
+func (f *fakeHostNetwork) SetDeviceVRF(netns, device, vrf string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	l, err := f.link(netns, device)
+	if err != nil {
+		return err
+	}
+	master, err := f.link(netns, vrf)
+	if err != nil {
+		return err
+	}
+	if master.kind != "vrf" {
+		return fmt.Errorf("%s is a %s link, not a vrf", vrf, master.kind)
+	}
+	l.vrf = vrf
+	return nil
+}
+
+func (f *fakeHostNetwork) FlushIPv4Addresses(netns, device string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	l, err := f.link(netns, device)
+	if err != nil {
+		return err
+	}
+	if l.kind != "dummy" {
+		return fmt.Errorf("refusing to flush addresses of %s link %s", l.kind, device)
+	}
+	l.addrs = nil
+	return nil
+}
+
+func (f *fakeHostNetwork) DeleteOwnedAddresses(netns, device, keepIP string) error {
+	label := ownedAddressLabel(device)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	l, err := f.link(netns, device)
+	if err != nil {
+		return err
+	}
+	l.addrs = slices.DeleteFunc(l.addrs, func(a fakeAddr) bool {
+		return a.label == label && a.ip != keepIP
+	})
+	return nil
+}
+
+func (f *fakeHostNetwork) AddAddress(netns, ip, device string, prefixLength int) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	l, err := f.link(netns, device)
+	if err != nil {
+		return false, err
+	}
+	label := ownedAddressLabel(device)
+	if slices.ContainsFunc(l.addrs, func(a fakeAddr) bool { return a.ip == ip && a.label != label }) {
+		return false, nil
+	}
+	l.addrs = slices.DeleteFunc(l.addrs, func(a fakeAddr) bool { return a.ip == ip })
+	l.addrs = append(l.addrs, fakeAddr{ip: ip, prefixLength: prefixLength, label: label})
+	return true, nil
+}
+
+func (f *fakeHostNetwork) DeleteAddress(netns, ip, device string, prefixLength int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	l, err := f.link(netns, device)
+	if err != nil {
+		return nil
+	}
+	l.addrs = slices.DeleteFunc(l.addrs, func(a fakeAddr) bool { return a.ip == ip })
+	return nil
+}
+
+func (f *fakeHostNetwork) HasAddress(netns, ip, device string) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	l, err := f.link(netns, device)
+	if err != nil {
+		return false, nil
+	}
+	return slices.ContainsFunc(l.addrs, func(a fakeAddr) bool { return a.ip == ip }), nil
+}
+
+// fakeIPVSService is an ipvs service of the fake load balancer
+type fakeIPVSService struct {
+	service      libipvs.Service
+	destinations []libipvs.Destination
+}
+
+// fakeLoadBalancer is an in-memory LoadBalancer. It keeps copies of the
+// services and destinations, like the kernel does.
+type fakeLoadBalancer struct {
+	mu       sync.Mutex
+	services map[string][]*fakeIPVSService
+	daemons  map[string][]ipvsSyncDaemon
+}
+
+func newFakeLoadBalancer() *fakeLoadBalancer {
+	return &fakeLoadBalancer{
+		services: map[string][]*fakeIPVSService{},
+		daemons:  map[string][]ipvsSyncDaemon{},
+	}
+}
+
+// Service returns a service and its destinations by key, or nil if it does
+// not exist
+func (f *fakeLoadBalancer) Service(netns, key string) *fakeIPVSService {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, s := range f.services[netns] {
+		if ipvsServiceKey(&s.service) == key {
+			return s
+		}
+	}
+	return nil
+}
+
+func (f *fakeLoadBalancer) find(netns string, svc *libipvs.Service) (*fakeIPVSService, error) {
+	for _, s := range f.services[netns] {
+		if ipvsServiceKey(&s.service) == ipvsServiceKey(svc) {
+			return s, nil
+		}
+	}
+	return nil, fmt.Errorf("ipvs service %s not found", ipvsServiceKey(svc))
+}
+
+func (f *fakeLoadBalancer) Services(netns string) ([]*libipvs.Service, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var svcs []*libipvs.Service
+	for _, s := range f.services[netns] {
+		svc := s.service
+		svcs = append(svcs, &svc)
+	}
+	return svcs, nil
+}
+
+func (f *fakeLoadBalancer) AddService(netns string, svc *libipvs.Service) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, err := f.find(netns, svc); err == nil {
+		return fmt.Errorf("ipvs service %s exists", ipvsServiceKey(svc))
+	}
+	f.services[netns] = append(f.services[netns], &fakeIPVSService{service: *svc})
+	return nil
+}
+
+func (f *fakeLoadBalancer) UpdateService(netns string, svc *libipvs.Service) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s, err := f.find(netns, svc)
+	if err != nil {
+		return err
+	}
+	s.service = *svc
+	return nil
+}
+
+func (f *fakeLoadBalancer) DeleteService(netns string, svc *libipvs.Service) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.services[netns] = slices.DeleteFunc(f.services[netns], func(s *fakeIPVSService) bool {
+		return ipvsServiceKey(&s.service) == ipvsServiceKey(svc)
+	})
+	return nil
+}
+
+func (f *fakeLoadBalancer) Destinations(netns string, svc *libipvs.Service) ([]*libipvs.Destination, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s, err := f.find(netns, svc)
+	if err != nil {
+		return nil, err
+	}
+	var dests []*libipvs.Destination
+	for _, d := range s.destinations {
+		dests = append(dests, &d)
+	}
+	return dests, nil
+}
+
+func (f *fakeLoadBalancer) AddDestination(netns string, svc *libipvs.Service, dest *libipvs.Destination) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s, err := f.find(netns, svc)
+	if err != nil {
+		return err
+	}
+	if slices.ContainsFunc(s.destinations, func(d libipvs.Destination) bool { return ipvsDestinationKey(&d) == ipvsDestinationKey(dest) }) {
+		return fmt.Errorf("ipvs destination %s exists", ipvsDestinationKey(dest))
+	}
+	s.destinations = append(s.destinations, *dest)
+	return nil
+}
+
+func (f *fakeLoadBalancer) UpdateDestination(netns string, svc *libipvs.Service, dest *libipvs.Destination) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s, err := f.find(netns, svc)
+	if err != nil {
+		return err
+	}
+	i := slices.IndexFunc(s.destinations, func(d libipvs.Destination) bool { return ipvsDestinationKey(&d) == ipvsDestinationKey(dest) })
+	if i < 0 {
+		return fmt.Errorf("ipvs destination %s not found", ipvsDestinationKey(dest))
+	}
+	// The kernel keeps the connection counters of updated destinations
+	d := *dest
+	d.ActiveConnections = s.destinations[i].ActiveConnections
+	d.InactiveConnections = s.destinations[i].InactiveConnections
+	d.Stats = s.destinations[i].Stats
+	s.destinations[i] = d
+	return nil
+}
+
+func (f *fakeLoadBalancer) DeleteDestination(netns string, svc *libipvs.Service, dest *libipvs.Destination) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s, err := f.find(netns, svc)
+	if err != nil {
+		return err
+	}
+	s.destinations = slices.DeleteFunc(s.destinations, func(d libipvs.Destination) bool { return ipvsDestinationKey(&d) == ipvsDestinationKey(dest) })
+	return nil
+}
+
+func (f *fakeLoadBalancer) SyncDaemons(netns string) ([]ipvsSyncDaemon, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.daemons[netns]), nil
+}
+
+func (f *fakeLoadBalancer) AddSyncDaemon(netns string, d ipvsSyncDaemon) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if slices.ContainsFunc(f.daemons[netns], func(r ipvsSyncDaemon) bool { return r.State == d.State }) {
+		return fmt.Errorf("ipvs %s sync daemon is running", d)
+	}
+	f.daemons[netns] = append(f.daemons[netns], d)
+	return nil
+}
+
+func (f *fakeLoadBalancer) DeleteSyncDaemon(netns string, state uint32) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.daemons[netns] = slices.DeleteFunc(f.daemons[netns], func(r ipvsSyncDaemon) bool { return r.State == state })
+	return nil
+}
+
+// fakeDestination returns a destination of the fake load balancer
+func fakeDestination(ip string, port uint16, weight int) libipvs.Destination {
+	return libipvs.Destination{
+		Address:         net.ParseIP(ip),
+		Port:            port,
+		Weight:          weight,
+		ConnectionFlags: libipvs.ConnFwdMasq,
+	}
+}
+
+// useHostRecord records the host resources in a temporary state file for the
+// duration of a test
+func useHostRecord(t *testing.T, host HostNetwork, lb LoadBalancer) {
+	var err error
+	hostRecord, err = loadHostState(filepath.Join(t.TempDir(), "state.json"), host, lb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { hostRecord = nil })
+}
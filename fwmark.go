@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// fwmarkChains are the mangle table chains that mark the traffic to the
+	// service ip, for both forwarded and locally generated traffic
+	fwmarkChains = []string{"PREROUTING", "OUTPUT"}
+)
+
+// ipvsFWMark returns the firewall mark of the service, or 0 when the ipvs
+// services are created per port
+func ipvsFWMark(serviceConfig serviceConfig) uint32 {
+	if serviceConfig.IPVS == nil {
+		return 0
+	}
+	return serviceConfig.IPVS.FWMark
+}
+
+// fwmarkRules returns the iptables rule specs that mark the traffic to the
+// service ip and ports
+func fwmarkRules(serviceConfig serviceConfig) [][]string {
+	var rules [][]string
+	for _, port := range serviceConfig.Ports {
+		dport := fmt.Sprint(port.ServicePort)
+		if port.ServicePortEnd > port.ServicePort {
+			dport = fmt.Sprintf("%d:%d", port.ServicePort, port.ServicePortEnd)
+		}
+		rules = append(rules, []string{
+			"-d", fmt.Sprintf("%s/32", serviceConfig.IP),
+			"-p", strings.ToLower(servicePortProtocol(serviceConfig, port)),
+			"--dport", dport,
+			"-m", "comment", "--comment", fmt.Sprintf("bgp-lb: %s", serviceConfig.Name),
+			"-j", "MARK", "--set-mark", fmt.Sprintf("0x%x", ipvsFWMark(serviceConfig)),
+		})
+	}
+	return rules
+}
+
+// ensureFWMarkRules adds the mangle rules that mark the service traffic, unless
+// they already exist
+func ensureFWMarkRules(serviceConfig serviceConfig) error {
+	for _, chain := range fwmarkChains {
+		for _, rule := range fwmarkRules(serviceConfig) {
+			exists, err := iptablesRuleExists(chain, rule)
+			if err != nil {
+				return err
+			}
+			// Rules are identified by their comment, so existing ones were
+			// added by bgp-lb as well
+			hostRecord.RecordFWMarkRule(serviceConfig.Netns, chain, rule)
+			if exists {
+				continue
+			}
+			if err := iptables(append([]string{"-t", "mangle", "-A", chain}, rule...)...); err != nil {
+				return err
+			}
+			log.WithFields(log.Fields{
+				"chain": chain,
+				"rule":  strings.Join(rule, " "),
+			}).Info("Added fwmark rule")
+		}
+	}
+	return nil
+}
+
+// deleteFWMarkRule deletes a mangle rule, if it exists
+func deleteFWMarkRule(chain string, rule []string) error {
+	exists, err := iptablesRuleExists(chain, rule)
+	if err != nil || !exists {
+		return err
+	}
+	if err := iptables(append([]string{"-t", "mangle", "-D", chain}, rule...)...); err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{
+		"chain": chain,
+		"rule":  strings.Join(rule, " "),
+	}).Info("Deleted fwmark rule")
+	return nil
+}
+
+// iptablesRuleExists checks whether a rule exists in a mangle table chain
+func iptablesRuleExists(chain string, rule []string) (bool, error) {
+	err := iptables(append([]string{"-t", "mangle", "-C", chain}, rule...)...)
+	if err == nil {
+		return true, nil
+	}
+	// iptables exits with 1 when the rule does not exist
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+		return false, nil
+	}
+	return false, err
+}
+
+// iptables runs the iptables command with the given arguments
+func iptables(args ...string) error {
+	out, err := exec.Command("iptables", append([]string{"-w"}, args...)...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("iptables %s: %w: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
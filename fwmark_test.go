@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFWMarkRules(t *testing.T) {
+	rules := fwmarkRules(serviceConfig{
+		Name:     "test",
+		IP:       "10.88.2.1",
+		Protocol: "tcp",
+		IPVS:     &ipvsServiceConfig{FWMark: 10},
+		Ports: []servicePortConfig{
+			{ServicePort: 80},
+			{ServicePort: 9000, ServicePortEnd: 9010, Protocol: "udp"},
+		},
+	})
+	assert.Equal(t, [][]string{
+		{"-d", "10.88.2.1/32", "-p", "tcp", "--dport", "80", "-m", "comment", "--comment", "bgp-lb: test", "-j", "MARK", "--set-mark", "0xa"},
+		{"-d", "10.88.2.1/32", "-p", "udp", "--dport", "9000:9010", "-m", "comment", "--comment", "bgp-lb: test", "-j", "MARK", "--set-mark", "0xa"},
+	}, rules)
+}
+
+func TestFWMarkSetup(t *testing.T) {
+	pool := newDestinationPool("10.88.2.1", "", nil)
+	fwmarkSetup(pool, serviceConfig{
+		IP:       "10.88.2.1",
+		Protocol: "tcp",
+		IPVS:     &ipvsServiceConfig{FWMark: 10},
+		Ports: []servicePortConfig{
+			{ServicePort: 80},
+			{ServicePort: 443},
+		},
+	}, "10.88.0.200")
+	assert.Equal(t, 1, len(pool.services))
+	assert.Equal(t, uint32(10), pool.services[0].FWMark)
+	assert.Equal(t, 1, len(pool.destinations))
+	assert.Equal(t, "10.88.0.200:0", ipvsDestinationKey(pool.destinations[0].dest))
+}
@@ -1,5 +1,7 @@
 package main
 
+import "encoding/json"
+
 // Result is the result of runing a health check.
 type Result struct {
 	healthy bool
@@ -16,6 +18,7 @@ type Checker interface {
 func healthCheckSetup(serviceConfig serviceConfig) Checker {
 	if serviceConfig.HttpHealthCheck != nil {
 		return NewHttpCheck(
+			"127.0.0.1",
 			serviceConfig.HttpHealthCheck.Path,
 			serviceConfig.HttpHealthCheck.Scheme,
 			serviceConfig.HttpHealthCheck.Port,
@@ -28,3 +31,59 @@ func healthCheckSetup(serviceConfig serviceConfig) Checker {
 	// Default to pinging well known DNS providers
 	return NewPingCheck([]string{"1.1.1.1", "8.8.8.8"})
 }
+
+// checkType returns the type of a healthcheck, used as a metric label
+func checkType(check Checker) string {
+	switch check.(type) {
+	case HttpCheck:
+		return "http"
+	case PingCheck:
+		return "ping"
+	}
+	return "other"
+}
+
+// realServerCheckSetup returns a new healthcheck for an ipvs real server. The
+// http check queries the real server address
+func realServerCheckSetup(realServer realServerConfig) Checker {
+	if realServer.HttpHealthCheck != nil {
+		return NewHttpCheck(
+			realServer.Address,
+			realServer.HttpHealthCheck.Path,
+			realServer.HttpHealthCheck.Scheme,
+			realServer.HttpHealthCheck.Port,
+			realServer.HttpHealthCheck.InsecureSkipVerify,
+		)
+	}
+	if realServer.PingHealthCheck != nil {
+		return NewPingCheck(realServer.PingHealthCheck.Addresses)
+	}
+	// Default to pinging the real server
+	return NewPingCheck([]string{realServer.Address})
+}
+
+// sharedCheck is a real server healthcheck shared by the destinations of the
+// real server across service ports, so that it runs once per check round
+type sharedCheck struct {
+	Checker
+}
+
+// realServerChecks holds the healthchecks of the real servers by address and
+// check config
+type realServerChecks map[string]*sharedCheck
+
+// Setup returns the healthcheck of a real server, shared with the real servers
+// of other ports that have the same address and check config
+func (c realServerChecks) Setup(realServer realServerConfig) Checker {
+	key, _ := json.Marshal(struct {
+		Address string
+		Http    *httpHealthCheckConfig
+		Ping    *pingHealthCheckConfig
+	}{realServer.Address, realServer.HttpHealthCheck, realServer.PingHealthCheck})
+	check, ok := c[string(key)]
+	if !ok {
+		check = &sharedCheck{realServerCheckSetup(realServer)}
+		c[string(key)] = check
+	}
+	return check
+}
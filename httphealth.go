@@ -4,7 +4,9 @@ import (
 	"crypto/tls"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"strconv"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -12,12 +14,13 @@ import (
 
 type HttpCheck struct {
 	client *http.Client
+	host   string
 	path   string
 	port   int
 	scheme string
 }
 
-func NewHttpCheck(path, scheme string, port int, insecureSkipVerify bool) HttpCheck {
+func NewHttpCheck(host, path, scheme string, port int, insecureSkipVerify bool) HttpCheck {
 	client := http.DefaultClient
 	if insecureSkipVerify {
 		client = &http.Client{
@@ -29,6 +32,7 @@ func NewHttpCheck(path, scheme string, port int, insecureSkipVerify bool) HttpCh
 	}
 	return HttpCheck{
 		client: client,
+		host:   host,
 		path:   path,
 		port:   port,
 		scheme: scheme,
@@ -40,10 +44,17 @@ func (hc HttpCheck) Check() Result {
 	if scheme == "" {
 		scheme = "http"
 	}
-	url := fmt.Sprintf("%s://127.0.0.1:%d/%s", scheme, hc.port, hc.path)
+	url := fmt.Sprintf("%s://%s/%s", scheme, net.JoinHostPort(hc.host, strconv.Itoa(hc.port)), hc.path)
+	// The check runs every second, repeat the warnings of a failing endpoint
+	// only once in a while
+	logKey := "http:" + url
 	resp, err := hc.client.Get(url)
 	if err != nil {
-		log.WithFields(log.Fields{"error": err}).Warn("error while trying to query HTTP endpoint")
+		repeatedLogs.Warn(logKey, log.WithFields(log.Fields{
+			"check": "http",
+			"url":   url,
+			"error": err,
+		}), "error while trying to query HTTP endpoint")
 		return Result{
 			healthy: false,
 			err:     err.Error(),
@@ -56,14 +67,29 @@ func (hc HttpCheck) Check() Result {
 	}()
 	bodyBytes, err := io.ReadAll(resp.Body)
 	if err != nil {
-		log.Fatal(err)
+		repeatedLogs.Warn(logKey, log.WithFields(log.Fields{
+			"check": "http",
+			"url":   url,
+			"error": err,
+		}), "error while reading the HTTP endpoint response")
+		return Result{
+			healthy: false,
+			err:     err.Error(),
+			output:  "",
+		}
 	}
 	body := string(bodyBytes)
 	healthy := true
 	// Non-2XX
 	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
-		log.WithFields(log.Fields{"code": resp.StatusCode}).Warn("invalid response from endpoint")
+		repeatedLogs.Warn(logKey, log.WithFields(log.Fields{
+			"check": "http",
+			"url":   url,
+			"code":  resp.StatusCode,
+		}), "invalid response from endpoint")
 		healthy = false
+	} else {
+		repeatedLogs.Reset(logKey)
 	}
 	return Result{
 		healthy: healthy,
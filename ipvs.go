@@ -1,76 +1,548 @@
 package main
 
 import (
+	"bufio"
+	"encoding/binary"
 	"fmt"
-	libipvs "github.com/moby/ipvs"
 	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 	"syscall"
+	"time"
+
+	libipvs "github.com/moby/ipvs"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
 )
 
-// addIPVSService adds a new ipvs service based on ip, protocol and listen port
-func addIPVSService(ip, proto string, port uint16) (*libipvs.Service, error) {
-	h, err := libipvs.New("")
-	if err != nil {
-		return nil, fmt.Errorf("IPVS interface can't be initialized: %v", err)
+const (
+	defaultIPVSScheduler = libipvs.RoundRobin
+	ipvsStatsInterval    = 10 * time.Second
+	ipvsDrainInterval    = time.Second
+	// Service flags, see include/uapi/linux/ip_vs.h
+	ipvsSvcFlagPersistent = 0x0001
+	ipvsSvcFlagHashed     = 0x0002 // set by the kernel
+	ipvsSvcFlagSched1     = 0x0008 // sh-fallback and mh-fallback
+	ipvsSvcFlagSched2     = 0x0010 // sh-port and mh-port
+)
+
+var (
+	// ipvsSchedulers are the schedulers shipped with the linux kernel
+	ipvsSchedulers = []string{"rr", "wrr", "lc", "wlc", "lblc", "lblcr", "dh", "sh", "sed", "nq", "fo", "ovf", "mh", "twos"}
+	// ipvsSchedulerFlags maps the supported scheduler flags to the service flags
+	ipvsSchedulerFlags = map[string]uint32{
+		"fallback": ipvsSvcFlagSched1,
+		"port":     ipvsSvcFlagSched2,
 	}
-	defer h.Close()
-	svc := toIPVSService(ip, proto, port)
-	return svc, h.NewService(svc)
+)
+
+// LoadBalancer manages the ipvs services and sync daemons of the host. An
+// empty netns is the current namespace.
+type LoadBalancer interface {
+	Services(netns string) ([]*libipvs.Service, error)
+	AddService(netns string, svc *libipvs.Service) error
+	UpdateService(netns string, svc *libipvs.Service) error
+	// DeleteService deletes an ipvs service, if it exists
+	DeleteService(netns string, svc *libipvs.Service) error
+	// Destinations returns the destinations of a service, including their
+	// traffic stats
+	Destinations(netns string, svc *libipvs.Service) ([]*libipvs.Destination, error)
+	AddDestination(netns string, svc *libipvs.Service, dest *libipvs.Destination) error
+	UpdateDestination(netns string, svc *libipvs.Service, dest *libipvs.Destination) error
+	DeleteDestination(netns string, svc *libipvs.Service, dest *libipvs.Destination) error
+	// SyncDaemons returns the running connection sync daemons
+	SyncDaemons(netns string) ([]ipvsSyncDaemon, error)
+	AddSyncDaemon(netns string, d ipvsSyncDaemon) error
+	DeleteSyncDaemon(netns string, state uint32) error
 }
 
-// addIPVSDestination add a destination (ip and port) under a service
-func addIPVSDestination(svc *libipvs.Service, ip string, port uint16) error {
-	h, err := libipvs.New("")
+// ipvsLoadBalancer is the LoadBalancer of the kernel, managed via libipvs. It
+// opens a handle in the namespace for every operation, so that a re-created
+// namespace is picked up.
+type ipvsLoadBalancer struct{}
+
+// handle runs fn with an ipvs handle in the given namespace
+func (ipvsLoadBalancer) handle(netns string, fn func(h *libipvs.Handle) error) error {
+	h, err := libipvs.New(netns)
 	if err != nil {
 		return fmt.Errorf("IPVS interface can't be initialized: %v", err)
 	}
 	defer h.Close()
-	return h.NewDestination(svc, toIPVSDestination(ip, port))
+	return fn(h)
+}
+
+func (lb ipvsLoadBalancer) Services(netns string) ([]*libipvs.Service, error) {
+	var svcs []*libipvs.Service
+	err := lb.handle(netns, func(h *libipvs.Handle) error {
+		var err error
+		svcs, err = h.GetServices()
+		return err
+	})
+	return svcs, err
+}
+
+func (lb ipvsLoadBalancer) AddService(netns string, svc *libipvs.Service) error {
+	return lb.handle(netns, func(h *libipvs.Handle) error { return h.NewService(svc) })
+}
+
+func (lb ipvsLoadBalancer) UpdateService(netns string, svc *libipvs.Service) error {
+	return lb.handle(netns, func(h *libipvs.Handle) error { return h.UpdateService(svc) })
+}
+
+func (lb ipvsLoadBalancer) DeleteService(netns string, svc *libipvs.Service) error {
+	return lb.handle(netns, func(h *libipvs.Handle) error {
+		if !h.IsServicePresent(svc) {
+			return nil
+		}
+		return h.DelService(svc)
+	})
 }
 
-// cleanIPVSServices deletes all ipvs services with the given ip
-func cleanIPVSServices(ip string) error {
-	h, err := libipvs.New("")
+func (lb ipvsLoadBalancer) Destinations(netns string, svc *libipvs.Service) ([]*libipvs.Destination, error) {
+	var dests []*libipvs.Destination
+	err := lb.handle(netns, func(h *libipvs.Handle) error {
+		var err error
+		dests, err = h.GetDestinations(svc)
+		return err
+	})
+	return dests, err
+}
+
+func (lb ipvsLoadBalancer) AddDestination(netns string, svc *libipvs.Service, dest *libipvs.Destination) error {
+	return lb.handle(netns, func(h *libipvs.Handle) error { return h.NewDestination(svc, dest) })
+}
+
+func (lb ipvsLoadBalancer) UpdateDestination(netns string, svc *libipvs.Service, dest *libipvs.Destination) error {
+	return lb.handle(netns, func(h *libipvs.Handle) error { return h.UpdateDestination(svc, dest) })
+}
+
+func (lb ipvsLoadBalancer) DeleteDestination(netns string, svc *libipvs.Service, dest *libipvs.Destination) error {
+	return lb.handle(netns, func(h *libipvs.Handle) error { return h.DelDestination(svc, dest) })
+}
+
+// ipvsServiceState is the desired state of an ipvs service and its
+// destinations
+type ipvsServiceState struct {
+	service      *libipvs.Service
+	destinations []*libipvs.Destination
+}
+
+// reconcileIPVSServices diffs the desired ipvs services of the given ip against
+// the ones in the kernel and applies only the needed changes, so that the
+// connections of the existing services are not affected
+func reconcileIPVSServices(lb LoadBalancer, netns, ip string, desired []ipvsServiceState) error {
+	svcs, err := lb.Services(netns)
 	if err != nil {
-		return fmt.Errorf("IPVS interface can't be initialized: %v", err)
+		return fmt.Errorf("Cannot retrieve ipvs services: %v", err)
 	}
-	defer h.Close()
-	svcs, err := h.GetServices()
+	serviceIP := net.ParseIP(ip)
+	fwmarks := map[uint32]bool{}
+	for _, state := range desired {
+		if state.service.FWMark != 0 {
+			fwmarks[state.service.FWMark] = true
+		}
+	}
+	actual := map[string]*libipvs.Service{}
+	for _, svc := range svcs {
+		if (svc.FWMark == 0 && svc.Address.Equal(serviceIP)) || fwmarks[svc.FWMark] {
+			actual[ipvsServiceKey(svc)] = svc
+		}
+	}
+	wanted := map[string]bool{}
+	for _, state := range desired {
+		key := ipvsServiceKey(state.service)
+		wanted[key] = true
+		fields := log.Fields{"ipvs_service": key}
+		svc, ok := actual[key]
+		if !ok {
+			if err := lb.AddService(netns, state.service); err != nil {
+				return fmt.Errorf("Cannot add ipvs svc %s: %v", key, err)
+			}
+			log.WithFields(fields).Info("Added ipvs service")
+		} else if !ipvsServiceEqual(svc, state.service) {
+			if err := lb.UpdateService(netns, state.service); err != nil {
+				return fmt.Errorf("Cannot update ipvs svc %s: %v", key, err)
+			}
+			log.WithFields(fields).Info("Updated ipvs service")
+		}
+		if err := reconcileIPVSDestinations(lb, netns, state); err != nil {
+			return err
+		}
+	}
+	for key, svc := range actual {
+		if wanted[key] {
+			continue
+		}
+		if err := lb.DeleteService(netns, svc); err != nil {
+			return fmt.Errorf("Cannot delete ipvs svc %s: %v", key, err)
+		}
+		hostRecord.ForgetIPVSServices(netns, []*libipvs.Service{svc})
+		log.WithFields(log.Fields{"ipvs_service": key}).Info("Deleted ipvs service")
+	}
+	return nil
+}
+
+// reconcileIPVSDestinations applies the needed changes to the destinations of
+// an ipvs service
+func reconcileIPVSDestinations(lb LoadBalancer, netns string, state ipvsServiceState) error {
+	dests, err := lb.Destinations(netns, state.service)
 	if err != nil {
-		return fmt.Errorf("Cannot retrieve ipvs services: %v", err)
+		return fmt.Errorf("Cannot retrieve ipvs destinations: %v", err)
+	}
+	svcKey := ipvsServiceKey(state.service)
+	actual := map[string]*libipvs.Destination{}
+	for _, d := range dests {
+		actual[ipvsDestinationKey(d)] = d
+	}
+	wanted := map[string]bool{}
+	for _, dest := range state.destinations {
+		key := ipvsDestinationKey(dest)
+		wanted[key] = true
+		fields := log.Fields{"ipvs_service": svcKey, "destination": key}
+		d, ok := actual[key]
+		if !ok {
+			if err := lb.AddDestination(netns, state.service, dest); err != nil {
+				return fmt.Errorf("Cannot add ipvs destination %s: %v", key, err)
+			}
+			log.WithFields(fields).Info("Added ipvs destination")
+		} else if d.Weight != dest.Weight ||
+			d.ConnectionFlags&libipvs.ConnFwdMask != dest.ConnectionFlags&libipvs.ConnFwdMask {
+			if err := lb.UpdateDestination(netns, state.service, dest); err != nil {
+				return fmt.Errorf("Cannot update ipvs destination %s: %v", key, err)
+			}
+			log.WithFields(fields).Info("Updated ipvs destination")
+		}
+	}
+	for key, d := range actual {
+		if wanted[key] {
+			continue
+		}
+		if err := lb.DeleteDestination(netns, state.service, d); err != nil {
+			return fmt.Errorf("Cannot delete ipvs destination %s: %v", key, err)
+		}
+		log.WithFields(log.Fields{"ipvs_service": svcKey, "destination": key}).Info("Deleted ipvs destination")
+	}
+	return nil
+}
+
+// ipvsServiceStats holds the kernel view of an ipvs service and its
+// destinations, including their traffic stats
+type ipvsServiceStats struct {
+	service      *libipvs.Service
+	destinations []*libipvs.Destination
+}
+
+// getIPVSStats returns the stats of the given services that exist in ipvs
+func getIPVSStats(lb LoadBalancer, netns string, services []*libipvs.Service) ([]ipvsServiceStats, error) {
+	svcs, err := lb.Services(netns)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot retrieve ipvs services: %v", err)
 	}
-	cleanIP := net.ParseIP(ip)
+	wanted := map[string]bool{}
+	for _, svc := range services {
+		wanted[ipvsServiceKey(svc)] = true
+	}
+	var stats []ipvsServiceStats
 	for _, svc := range svcs {
-		if svc.Address.Equal(cleanIP) {
-			if err := h.DelService(svc); err != nil {
-				return fmt.Errorf("Cannot delete ipvs svc: %v", err)
+		if !wanted[ipvsServiceKey(svc)] {
+			continue
+		}
+		dests, err := lb.Destinations(netns, svc)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot retrieve destinations of ipvs service %s: %v", ipvsServiceKey(svc), err)
+		}
+		stats = append(stats, ipvsServiceStats{service: svc, destinations: dests})
+	}
+	return stats, nil
+}
+
+// activeIPVSConnections returns the number of active connections to the
+// destinations of the given services
+func activeIPVSConnections(lb LoadBalancer, netns string, services []*libipvs.Service) (int, error) {
+	stats, err := getIPVSStats(lb, netns, services)
+	if err != nil {
+		return 0, err
+	}
+	active := 0
+	for _, s := range stats {
+		for _, d := range s.destinations {
+			active += d.ActiveConnections
+		}
+	}
+	return active, nil
+}
+
+// updateIPVSDestinationWeight sets the weight of a destination under a
+// service. Weight 0 stops new connections to the destination while keeping the
+// established ones
+func updateIPVSDestinationWeight(lb LoadBalancer, netns string, svc *libipvs.Service, dest *libipvs.Destination, weight int) error {
+	d := *dest
+	d.Weight = weight
+	return lb.UpdateDestination(netns, svc, &d)
+}
+
+// ipvsServiceKey identifies an ipvs service of an ip
+func ipvsServiceKey(svc *libipvs.Service) string {
+	if svc.FWMark != 0 {
+		return fmt.Sprintf("fwmark:%d", svc.FWMark)
+	}
+	return fmt.Sprintf("%s:%s:%d", protocolToString(svc.Protocol), svc.Address, svc.Port)
+}
+
+// ipvsDestinationKey identifies a destination of an ipvs service
+func ipvsDestinationKey(d *libipvs.Destination) string {
+	return net.JoinHostPort(d.Address.String(), strconv.Itoa(int(d.Port)))
+}
+
+// ipvsServiceEqual compares the options of two ipvs services, ignoring the
+// flags set by the kernel
+func ipvsServiceEqual(a, b *libipvs.Service) bool {
+	return a.SchedName == b.SchedName &&
+		a.Flags&^ipvsSvcFlagHashed == b.Flags&^ipvsSvcFlagHashed &&
+		a.Timeout == b.Timeout &&
+		a.Netmask == b.Netmask
+}
+
+// validateIPVSConfig checks the ipvs options of a service and that the
+// scheduler is supported by the kernel
+func validateIPVSConfig(serviceConfig serviceConfig) error {
+	if c := serviceConfig.IPVS; c != nil {
+		scheduler := ipvsScheduler(c)
+		if !slices.Contains(ipvsSchedulers, scheduler) {
+			return fmt.Errorf("unknown ipvs scheduler: %s", scheduler)
+		}
+		if err := checkIPVSSchedulerModule(scheduler); err != nil {
+			return err
+		}
+		for _, flag := range c.SchedulerFlags {
+			if scheduler != libipvs.SourceHashing && scheduler != "mh" {
+				return fmt.Errorf("ipvs scheduler %s does not support flags", scheduler)
+			}
+			if _, ok := ipvsSchedulerFlags[flag]; !ok {
+				return fmt.Errorf("unknown ipvs scheduler flag: %s", flag)
+			}
+		}
+		if c.PersistenceNetmask < 0 || c.PersistenceNetmask > 32 {
+			return fmt.Errorf("invalid ipvs persistence netmask: %d", c.PersistenceNetmask)
+		}
+		if c.DrainTimeoutSeconds < 0 || c.DrainThreshold < 0 {
+			return fmt.Errorf("invalid ipvs drain timeout %d or threshold %d", c.DrainTimeoutSeconds, c.DrainThreshold)
+		}
+	}
+	for _, port := range serviceConfig.Ports {
+		protocol := servicePortProtocol(serviceConfig, port)
+		if stringToProtocol(protocol) == 0 {
+			return fmt.Errorf("unsupported protocol %q for port %d", protocol, port.ServicePort)
+		}
+		if port.ServicePortEnd != 0 && port.ServicePortEnd < port.ServicePort {
+			return fmt.Errorf("invalid port range %d-%d", port.ServicePort, port.ServicePortEnd)
+		}
+		if span := int(max(port.ServicePortEnd, port.ServicePort) - port.ServicePort); int(port.TargetPort)+span > 65535 {
+			return fmt.Errorf("target port range of port %d exceeds 65535", port.ServicePort)
+		}
+		if err := validateIPVSDestination(port.ForwardingMethod, port.Weight); err != nil {
+			return err
+		}
+		for _, rs := range port.RealServers {
+			if net.ParseIP(rs.Address).To4() == nil {
+				return fmt.Errorf("invalid real server address: %s", rs.Address)
+			}
+			if err := validateIPVSDestination(rs.ForwardingMethod, rs.Weight); err != nil {
+				return err
+			}
+		}
+	}
+	if ipvsFWMark(serviceConfig) != 0 {
+		// Fwmark services forward the traffic to the same destination port
+		for _, port := range expandServicePorts(serviceConfig) {
+			if port.TargetPort != port.ServicePort {
+				return fmt.Errorf("fwmark services cannot map port %d to %d", port.ServicePort, port.TargetPort)
+			}
+			for _, rs := range port.RealServers {
+				if rs.Port != port.ServicePort {
+					return fmt.Errorf("fwmark services cannot map port %d to %d for real server %s", port.ServicePort, rs.Port, rs.Address)
+				}
+			}
+		}
+	}
+	// Protocols are case insensitive, so the normalized ones are compared
+	seen := map[string]bool{}
+	for _, port := range expandServicePorts(serviceConfig) {
+		key := fmt.Sprintf("%s/%d", protocolToString(stringToProtocol(port.Protocol)), port.ServicePort)
+		if seen[key] {
+			return fmt.Errorf("duplicate service port %s", key)
+		}
+		seen[key] = true
+	}
+	return nil
+}
+
+// servicePortProtocol returns the protocol of a service port, falling back to
+// the service protocol
+func servicePortProtocol(serviceConfig serviceConfig, port servicePortConfig) string {
+	if port.Protocol != "" {
+		return port.Protocol
+	}
+	return serviceConfig.Protocol
+}
+
+// expandServicePorts returns one entry per port and protocol of the service,
+// expanding port ranges. Target and real server ports are offset within a
+// range and default to the service port when not set.
+func expandServicePorts(serviceConfig serviceConfig) []servicePortConfig {
+	var ports []servicePortConfig
+	for _, port := range serviceConfig.Ports {
+		end := max(port.ServicePortEnd, port.ServicePort)
+		for p := uint32(port.ServicePort); p <= uint32(end); p++ {
+			offset := uint16(p) - port.ServicePort
+			expanded := port
+			expanded.ServicePort = uint16(p)
+			expanded.ServicePortEnd = 0
+			expanded.Protocol = servicePortProtocol(serviceConfig, port)
+			expanded.TargetPort = offsetPort(port.TargetPort, uint16(p), offset)
+			expanded.RealServers = make([]realServerConfig, len(port.RealServers))
+			for i, rs := range port.RealServers {
+				rs.Port = offsetPort(rs.Port, uint16(p), offset)
+				expanded.RealServers[i] = rs
 			}
+			ports = append(ports, expanded)
 		}
 	}
+	return ports
+}
+
+// offsetPort returns the target port for the given offset within a port range,
+// or the service port if the target port is not set
+func offsetPort(target, servicePort, offset uint16) uint16 {
+	if target == 0 {
+		return servicePort
+	}
+	return target + offset
+}
+
+// validateIPVSDestination checks the forwarding method and weight of a
+// destination
+func validateIPVSDestination(forwardingMethod string, weight *int) error {
+	if _, err := toForwardingMethod(forwardingMethod); err != nil {
+		return err
+	}
+	if weight != nil && (*weight < 0 || *weight > 65535) {
+		return fmt.Errorf("invalid ipvs destination weight: %d", *weight)
+	}
 	return nil
 }
 
-// toIPVSService converts ip, protocol and port to the equivalent IPVS Service
-// structure.
-func toIPVSService(ip, proto string, port uint16) *libipvs.Service {
-	return &libipvs.Service{
+// checkIPVSSchedulerModule checks that the scheduler module is either loaded,
+// built in the kernel or available to be loaded. If the kernel modules cannot
+// be inspected, e.g. when running in a container without /lib/modules, the
+// scheduler is assumed to be supported.
+func checkIPVSSchedulerModule(scheduler string) error {
+	module := "ip_vs_" + scheduler
+	if _, err := os.Stat(filepath.Join("/sys/module", module)); err == nil {
+		return nil
+	}
+	var uts unix.Utsname
+	if err := unix.Uname(&uts); err != nil {
+		return fmt.Errorf("cannot get kernel release: %v", err)
+	}
+	modulesDir := filepath.Join("/lib/modules", unix.ByteSliceToString(uts.Release[:]))
+	if _, err := os.Stat(modulesDir); err != nil {
+		log.WithFields(log.Fields{
+			"scheduler": scheduler,
+		}).Warn("Cannot verify kernel support for ipvs scheduler")
+		return nil
+	}
+	if builtin, err := os.Open(filepath.Join(modulesDir, "modules.builtin")); err == nil {
+		defer builtin.Close()
+		scanner := bufio.NewScanner(builtin)
+		for scanner.Scan() {
+			if filepath.Base(scanner.Text()) == module+".ko" {
+				return nil
+			}
+		}
+	}
+	matches, _ := filepath.Glob(filepath.Join(modulesDir, "kernel", "net", "netfilter", "ipvs", module+".ko*"))
+	if len(matches) > 0 {
+		return nil
+	}
+	return fmt.Errorf("ipvs scheduler %s is not supported by the kernel", scheduler)
+}
+
+// ipvsScheduler returns the configured scheduler or the default one
+func ipvsScheduler(ipvsConfig *ipvsServiceConfig) string {
+	if ipvsConfig == nil || ipvsConfig.Scheduler == "" {
+		return defaultIPVSScheduler
+	}
+	return ipvsConfig.Scheduler
+}
+
+// toIPVSService converts ip, protocol, port and the service options to the
+// equivalent IPVS Service structure.
+func toIPVSService(ip, proto string, port uint16, ipvsConfig *ipvsServiceConfig) *libipvs.Service {
+	svc := &libipvs.Service{
 		Address:       net.ParseIP(ip),
 		Protocol:      stringToProtocol(proto),
 		Port:          port,
-		SchedName:     "rr",
+		SchedName:     ipvsScheduler(ipvsConfig),
 		AddressFamily: syscall.AF_INET,
 		Netmask:       0xffffffff,
 	}
+	if ipvsConfig == nil {
+		return svc
+	}
+	for _, flag := range ipvsConfig.SchedulerFlags {
+		svc.Flags |= ipvsSchedulerFlags[flag]
+	}
+	if ipvsConfig.PersistenceTimeout > 0 {
+		svc.Flags |= ipvsSvcFlagPersistent
+		svc.Timeout = ipvsConfig.PersistenceTimeout
+		if ipvsConfig.PersistenceNetmask > 0 {
+			// The kernel expects the mask in network byte order
+			svc.Netmask = binary.NativeEndian.Uint32(net.CIDRMask(ipvsConfig.PersistenceNetmask, 32))
+		}
+	}
+	return svc
 }
 
-// toIPVSDestination converts a RealServer to the equivalent IPVS Destination structure.
-func toIPVSDestination(ip string, port uint16) *libipvs.Destination {
-	return &libipvs.Destination{
-		Address: net.ParseIP(ip),
-		Port:    port,
-		Weight:  1,
+// toIPVSFWMarkService returns an IPVS Service structure that matches the
+// traffic with the given firewall mark
+func toIPVSFWMarkService(fwmark uint32, ipvsConfig *ipvsServiceConfig) *libipvs.Service {
+	svc := toIPVSService("", "", 0, ipvsConfig)
+	svc.FWMark = fwmark
+	return svc
+}
+
+// toIPVSDestination converts a RealServer to the equivalent IPVS Destination
+// structure. Weight defaults to 1 if not set.
+func toIPVSDestination(ip string, port uint16, forwardingMethod string, weight *int) *libipvs.Destination {
+	flags, _ := toForwardingMethod(forwardingMethod)
+	d := &libipvs.Destination{
+		Address:         net.ParseIP(ip),
+		Port:            port,
+		Weight:          1,
+		ConnectionFlags: flags,
+	}
+	if weight != nil {
+		d.Weight = *weight
 	}
+	return d
+}
+
+// toForwardingMethod returns the ipvs connection flags for the given
+// forwarding method name. Masquerading is used if not set.
+func toForwardingMethod(method string) (uint32, error) {
+	switch strings.ToLower(method) {
+	case "", "masq":
+		return libipvs.ConnFwdMasq, nil
+	case "dr":
+		return libipvs.ConnFwdDirectRoute, nil
+	case "tunnel":
+		return libipvs.ConnFwdTunnel, nil
+	}
+	return 0, fmt.Errorf("unknown ipvs forwarding method: %s", method)
 }
 
 // stringToProtocolType returns the protocol type for the given name
@@ -85,3 +557,16 @@ func stringToProtocol(protocol string) uint16 {
 	}
 	return uint16(0)
 }
+
+// protocolToString returns the name of the given protocol type
+func protocolToString(protocol uint16) string {
+	switch protocol {
+	case syscall.IPPROTO_TCP:
+		return "tcp"
+	case syscall.IPPROTO_UDP:
+		return "udp"
+	case syscall.IPPROTO_SCTP:
+		return "sctp"
+	}
+	return fmt.Sprint(protocol)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	libipvs "github.com/moby/ipvs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestToIPVSService(t *testing.T) {
+	svc := toIPVSService("10.88.2.1", "tcp", 80, nil)
+	assert.Equal(t, "rr", svc.SchedName)
+	assert.Equal(t, uint32(0), svc.Flags)
+	assert.Equal(t, uint32(0xffffffff), svc.Netmask)
+
+	svc = toIPVSService("10.88.2.1", "tcp", 80, &ipvsServiceConfig{
+		Scheduler:          "mh",
+		SchedulerFlags:     []string{"fallback", "port"},
+		PersistenceTimeout: 300,
+		PersistenceNetmask: 24,
+	})
+	assert.Equal(t, "mh", svc.SchedName)
+	assert.Equal(t, uint32(ipvsSvcFlagPersistent|ipvsSvcFlagSched1|ipvsSvcFlagSched2), svc.Flags)
+	assert.Equal(t, uint32(300), svc.Timeout)
+	assert.Equal(t, []byte(net.CIDRMask(24, 32)), nativeEndianBytes(svc.Netmask))
+}
+
+func TestToIPVSDestination(t *testing.T) {
+	d := toIPVSDestination("10.88.0.200", 8080, "", nil)
+	assert.Equal(t, 1, d.Weight)
+	assert.Equal(t, uint32(libipvs.ConnFwdMasq), d.ConnectionFlags)
+
+	weight := 0
+	d = toIPVSDestination("10.88.0.200", 8080, "dr", &weight)
+	assert.Equal(t, 0, d.Weight)
+	assert.Equal(t, uint32(libipvs.ConnFwdDirectRoute), d.ConnectionFlags)
+}
+
+func TestValidateIPVSConfig(t *testing.T) {
+	weight := -1
+	tests := []struct {
+		name   string
+		config serviceConfig
+	}{
+		{"unknown scheduler", serviceConfig{IPVS: &ipvsServiceConfig{Scheduler: "foo"}}},
+		{"flags on rr", serviceConfig{IPVS: &ipvsServiceConfig{SchedulerFlags: []string{"port"}}}},
+		{"invalid netmask", serviceConfig{IPVS: &ipvsServiceConfig{PersistenceNetmask: 33}}},
+		{"negative drain timeout", serviceConfig{IPVS: &ipvsServiceConfig{DrainTimeoutSeconds: -1}}},
+		{"unknown forwarding", serviceConfig{Protocol: "tcp", Ports: []servicePortConfig{{ForwardingMethod: "nat"}}}},
+		{"negative weight", serviceConfig{Protocol: "tcp", Ports: []servicePortConfig{{Weight: &weight}}}},
+		{"unknown protocol", serviceConfig{Ports: []servicePortConfig{{ServicePort: 80, Protocol: "icmp"}}}},
+		{"invalid range", serviceConfig{Protocol: "tcp", Ports: []servicePortConfig{{ServicePort: 80, ServicePortEnd: 79}}}},
+		{"target range overflow", serviceConfig{Protocol: "tcp", Ports: []servicePortConfig{{ServicePort: 80, ServicePortEnd: 90, TargetPort: 65530}}}},
+		{"duplicate port", serviceConfig{Protocol: "tcp", Ports: []servicePortConfig{{ServicePort: 80}, {ServicePort: 78, ServicePortEnd: 80}}}},
+		{"duplicate port in other case", serviceConfig{Protocol: "tcp", Ports: []servicePortConfig{{ServicePort: 53}, {ServicePort: 53, Protocol: "TCP"}}}},
+		{"fwmark target port", serviceConfig{Protocol: "tcp", IPVS: &ipvsServiceConfig{FWMark: 1}, Ports: []servicePortConfig{{ServicePort: 53, TargetPort: 5353}}}},
+		{"fwmark real server port", serviceConfig{Protocol: "tcp", IPVS: &ipvsServiceConfig{FWMark: 1}, Ports: []servicePortConfig{{ServicePort: 80, RealServers: []realServerConfig{{Address: "10.88.1.10", Port: 8080}}}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Error(t, validateIPVSConfig(tt.config))
+		})
+	}
+}
+
+func nativeEndianBytes(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.NativeEndian.PutUint32(b, v)
+	return b
+}
+
+func TestIPVSServiceEqual(t *testing.T) {
+	desired := toIPVSService("10.88.2.1", "tcp", 80, nil)
+	actual := *desired
+	actual.Flags |= ipvsSvcFlagHashed
+	assert.True(t, ipvsServiceEqual(&actual, desired))
+
+	actual.SchedName = "wrr"
+	assert.False(t, ipvsServiceEqual(&actual, desired))
+}
+
+func TestIPVSKeys(t *testing.T) {
+	assert.Equal(t, "tcp:10.88.2.1:80", ipvsServiceKey(toIPVSService("10.88.2.1", "tcp", 80, nil)))
+	assert.Equal(t, "udp:10.88.2.1:53", ipvsServiceKey(toIPVSService("10.88.2.1", "udp", 53, nil)))
+	assert.Equal(t, "fwmark:8", ipvsServiceKey(toIPVSFWMarkService(8, nil)))
+	assert.Equal(t, "10.88.0.200:8080", ipvsDestinationKey(toIPVSDestination("10.88.0.200", 8080, "", nil)))
+}
+
+func TestExpandServicePorts(t *testing.T) {
+	ports := expandServicePorts(serviceConfig{
+		Protocol: "tcp",
+		Ports: []servicePortConfig{
+			{ServicePort: 53, TargetPort: 5353},
+			{ServicePort: 53, TargetPort: 5353, Protocol: "udp"},
+			{ServicePort: 8000, ServicePortEnd: 8002, RealServers: []realServerConfig{
+				{Address: "10.88.1.10", Port: 9000},
+				{Address: "10.88.1.11"},
+			}},
+		},
+	})
+	assert.Equal(t, 5, len(ports))
+	assert.Equal(t, "tcp", ports[0].Protocol)
+	assert.Equal(t, "udp", ports[1].Protocol)
+	assert.Equal(t, uint16(5353), ports[1].TargetPort)
+	for i, p := range ports[2:] {
+		assert.Equal(t, "tcp", p.Protocol)
+		assert.Equal(t, uint16(8000+i), p.ServicePort)
+		assert.Equal(t, uint16(8000+i), p.TargetPort)
+		assert.Equal(t, uint16(9000+i), p.RealServers[0].Port)
+		assert.Equal(t, uint16(8000+i), p.RealServers[1].Port)
+	}
+}
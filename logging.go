@@ -0,0 +1,127 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// logRepeatInterval is the minimum interval between the warnings repeated on
+// every check, like the ones of a persistently failing healthcheck
+const logRepeatInterval = time.Minute
+
+// repeatedLogs limits the warnings logged on every check
+var repeatedLogs = newLogLimiter(logRepeatInterval, realClock{})
+
+func initLogger(logLevel, logFormat string) {
+	switch logFormat {
+	case "text":
+		log.SetFormatter(&log.TextFormatter{})
+	case "json":
+		log.SetFormatter(&log.JSONFormatter{})
+	default:
+		log.WithFields(log.Fields{
+			"format": logFormat}).Fatal("Unsupported log format")
+	}
+
+	switch logLevel {
+	case "debug":
+		log.SetLevel(log.DebugLevel)
+	case "info":
+		log.SetLevel(log.InfoLevel)
+	case "warning":
+		log.SetLevel(log.WarnLevel)
+	case "error":
+		log.SetLevel(log.ErrorLevel)
+	default:
+		log.WithFields(log.Fields{
+			"level": logLevel}).Fatal("Unsupported log level")
+	}
+}
+
+// fieldsHook adds its fields to every log entry that does not set them, so
+// that all the lines carry the service context
+type fieldsHook log.Fields
+
+func (h fieldsHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (h fieldsHook) Fire(entry *log.Entry) error {
+	for k, v := range h {
+		if _, ok := entry.Data[k]; !ok {
+			entry.Data[k] = v
+		}
+	}
+	return nil
+}
+
+// logLimiter logs a message with a given key at most once per interval and
+// counts the suppressed repeats
+type logLimiter struct {
+	interval time.Duration
+	clock    clock
+
+	mu   sync.Mutex
+	keys map[string]*limitedLog
+}
+
+type limitedLog struct {
+	last       time.Time
+	suppressed int
+}
+
+func newLogLimiter(interval time.Duration, clock clock) *logLimiter {
+	return &logLimiter{
+		interval: interval,
+		clock:    clock,
+		keys:     map[string]*limitedLog{},
+	}
+}
+
+// Allow returns whether a message with the key should be logged and, if so,
+// the number of repeats suppressed since the last one
+func (l *logLimiter) Allow(key string) (bool, int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.clock.Now()
+	k, ok := l.keys[key]
+	if !ok {
+		l.keys[key] = &limitedLog{last: now}
+		return true, 0
+	}
+	if now.Sub(k.last) < l.interval {
+		k.suppressed++
+		return false, 0
+	}
+	suppressed := k.suppressed
+	k.last, k.suppressed = now, 0
+	return true, suppressed
+}
+
+// Reset forgets the key, so that the next message is logged right away, and
+// returns the number of repeats suppressed since the last one
+func (l *logLimiter) Reset(key string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	k, ok := l.keys[key]
+	if !ok {
+		return 0
+	}
+	delete(l.keys, key)
+	return k.suppressed
+}
+
+// Warn logs the entry as a warning if allowed for the key, adding the number
+// of suppressed repeats
+func (l *logLimiter) Warn(key string, entry *log.Entry, msg string) {
+	ok, suppressed := l.Allow(key)
+	if !ok {
+		return
+	}
+	if suppressed > 0 {
+		entry = entry.WithField("suppressed", suppressed)
+	}
+	entry.Warn(msg)
+}
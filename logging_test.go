@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testLogger returns a logger writing json lines to the returned buffer
+func testLogger() (*log.Logger, *bytes.Buffer) {
+	var buf bytes.Buffer
+	logger := log.New()
+	logger.SetOutput(&buf)
+	logger.SetFormatter(&log.JSONFormatter{})
+	return logger, &buf
+}
+
+// logLines decodes the json lines logged in the buffer
+func logLines(t *testing.T, buf *bytes.Buffer) []map[string]any {
+	t.Helper()
+	var lines []map[string]any
+	dec := json.NewDecoder(buf)
+	for dec.More() {
+		var line map[string]any
+		require.NoError(t, dec.Decode(&line))
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func TestFieldsHook(t *testing.T) {
+	logger, buf := testLogger()
+	logger.AddHook(fieldsHook{"service": "test", "vip": "10.0.0.10"})
+
+	logger.Info("default fields")
+	logger.WithFields(log.Fields{"service": "other", "peer": "10.0.0.254"}).Info("own fields")
+
+	lines := logLines(t, buf)
+	require.Len(t, lines, 2)
+	assert.Equal(t, "test", lines[0]["service"])
+	assert.Equal(t, "10.0.0.10", lines[0]["vip"])
+	assert.Equal(t, "other", lines[1]["service"])
+	assert.Equal(t, "10.0.0.10", lines[1]["vip"])
+	assert.Equal(t, "10.0.0.254", lines[1]["peer"])
+}
+
+func TestLogLimiter(t *testing.T) {
+	clk := &fakeClock{now: time.Unix(0, 0)}
+	limiter := newLogLimiter(time.Minute, clk)
+	logger, buf := testLogger()
+	warn := func() {
+		limiter.Warn("check", logger.WithField("check", "http"), "Healthcheck failed")
+	}
+
+	// Only the first of the repeated warnings within the interval is logged
+	for range 10 {
+		warn()
+		clk.Advance(time.Second)
+	}
+	lines := logLines(t, buf)
+	require.Len(t, lines, 1)
+	assert.NotContains(t, lines[0], "suppressed")
+
+	// The next one after the interval counts the suppressed ones
+	clk.Advance(time.Minute)
+	warn()
+	lines = logLines(t, buf)
+	require.Len(t, lines, 1)
+	assert.Equal(t, float64(9), lines[0]["suppressed"])
+	assert.Equal(t, "http", lines[0]["check"])
+
+	// Other keys are limited separately
+	limiter.Warn("other", logger.WithFields(nil), "Other warning")
+	assert.Len(t, logLines(t, buf), 1)
+
+	// After a reset the warning is logged right away
+	warn()
+	assert.Equal(t, 1, limiter.Reset("check"))
+	warn()
+	lines = logLines(t, buf)
+	require.Len(t, lines, 1)
+	assert.NotContains(t, lines[0], "suppressed")
+}
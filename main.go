@@ -1,105 +1,171 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
-var (
-	advertised       = false // advertised holds a bool value to show whether the service ip is bgp advertised
-	flagConfig       = flag.String("config", "/etc/bgp-lb/config.json", "Config file path")
-	flagLogLevel     = flag.String("log-level", "info", "Log level (debug|info|warning|error)")
-	flagNetworkSetup = flag.Bool("network-setup", true, "Whether to set up a net interface for the service address on the host")
-	flagIPVSSetup    = flag.Bool("ipvs-setup", false, "Will flush IPVS table and add a route from the service address to the target host port. Effective only when combined with -network-setup")
-	flagMetricsAddr  = flag.String("metrics-address", ":8081", "Metrics server address")
-)
+// version is set at build time
+var version = "dev"
 
-func initLogger(logLevel string) {
-	log.SetFormatter(&log.TextFormatter{})
+// restartSignal stops the process for a restart, keeping the advertised path
+// and the host networking when graceful restart is configured
+const restartSignal = syscall.SIGUSR1
 
-	switch logLevel {
-	case "debug":
-		log.SetLevel(log.DebugLevel)
-	case "info":
-		log.SetLevel(log.InfoLevel)
-	case "warning":
-		log.SetLevel(log.WarnLevel)
-	case "error":
-		log.SetLevel(log.ErrorLevel)
-	default:
-		log.WithFields(log.Fields{
-			"level": logLevel}).Fatal("Unsupported log level")
-	}
-}
+var (
+	flagConfig          = flag.String("config", "/etc/bgp-lb/config.json", "Config file path")
+	flagLogLevel        = flag.String("log-level", "info", "Log level (debug|info|warning|error)")
+	flagLogFormat       = flag.String("log-format", "text", "Log format (text|json)")
+	flagNetworkSetup    = flag.Bool("network-setup", true, "Whether to set up a net interface for the service address on the host")
+	flagNetworkInterval = flag.Duration("network-reconcile-interval", 10*time.Second, "Interval to check that the service device and address exist on the host, in addition to watching netlink updates")
+	flagBindOnAdvertise = flag.Bool("bind-on-advertise", false, "Add the service address and the IPVS services only while the service is advertised, so that the host does not answer for the service ip otherwise. Effective only when combined with -network-setup")
+	flagIPVSSetup       = flag.Bool("ipvs-setup", false, "Will reconcile the IPVS services of the service address to route to the target host port or the real servers. Effective only when combined with -network-setup")
+	flagIPVSInterval    = flag.Duration("ipvs-reconcile-interval", 30*time.Second, "Interval to reconcile the IPVS services and repair any drift")
+	flagMetricsAddr     = flag.String("metrics-address", ":8081", "Metrics server address")
+	flagRestarting      = flag.Bool("graceful-restart", false, "Signal to the bgp peers that the process is restarting, so they keep the previously advertised paths. Effective only when graceful restart is configured")
+	flagStateFile       = flag.String("state-file", "/var/lib/bgp-lb/state.json", "File recording the host resources set up by bgp-lb, so that they can be removed on shutdown or by the cleanup command")
+)
 
 func main() {
 	flag.Parse()
-	initLogger(*flagLogLevel)
+	initLogger(*flagLogLevel, *flagLogFormat)
+	if flag.Arg(0) == "cleanup" {
+		cleanup()
+		return
+	}
 	config, err := readConfig(*flagConfig)
 	if err != nil {
 		log.WithFields(log.Fields{
 			"error": err,
 		}).Fatal("Failed to read config file")
 	}
+	log.AddHook(fieldsHook{
+		"service": config.Service.Name,
+		"vip":     config.Service.IP,
+	})
 
-	bgp := bgpSetup(config.Bgp)
+	notifications, err = newNotifier(config, realClock{})
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Fatal("Invalid webhook config")
+	}
+	notifications.Start()
+
+	bgp := bgpSetup(config.Bgp, *flagRestarting)
+	host, lb := netlinkHost{}, ipvsLoadBalancer{}
+	destinations := newDestinationPool(config.Service.IP, config.Service.Netns, lb)
+	var device *serviceDevice
 	if *flagNetworkSetup {
-		netlinkSetup(config.Service, config.Bgp.Local.RouterId, *flagIPVSSetup)
+		hostRecord, err = loadHostState(*flagStateFile, host, lb)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+			}).Fatal("Cannot load host state")
+		}
+		destinations = netlinkSetup(host, lb, config.Service, config.Bgp.Local.RouterId, *flagIPVSSetup, *flagBindOnAdvertise)
+		device = newServiceDevice(config.Service, !*flagBindOnAdvertise, host)
+		go device.Watch(*flagNetworkInterval)
+		if *flagIPVSSetup {
+			go destinations.WatchReconcile(*flagIPVSInterval)
+			go destinations.WatchStats(config.Service.Name, ipvsStatsInterval)
+			if config.IPVSSync != nil {
+				ipvsSyncSetup(lb, config.Service.Netns, config.IPVSSync)
+			}
+		}
 	}
+	registerAdminHandlers()
+	setBuildInfoMetric(version, config.hash)
 	go startMetricsServer(*flagMetricsAddr)
 	// init metric with 0 value, in case healthcheck fails
 	unsetBGPPathAdvertisementMetric(config.Service.IP, fmt.Sprint(config.Service.PrefixLength), config.Bgp.Local.RouterId)
 
-	h := healthCheckSetup(config.Service)
-	for t := time.Tick(time.Second * time.Duration(1)); ; <-t {
-		log.Debug("Running a new healthcheck")
-		res := h.Check()
-		if res.err != "" {
-			log.Warn(fmt.Sprintf("Healthcheck error: %s\n", res.err))
-		}
-		if res.healthy {
-			log.Debug("Healthcheck succeeded")
-		} else {
-			if res.output != "" {
-				log.Warn(fmt.Sprintf("Healthcheck failed: %s\n", res.output))
-			} else {
-				log.Warn("Healthcheck failed")
-			}
-		}
-		if res.healthy && !advertised {
-			ServiceOn(bgp, config)
-		}
-		if !res.healthy && advertised {
-			ServiceOff(bgp, config)
-		}
+	controller := NewServiceController(config, healthCheckSetup(config.Service), bgp, destinations, device, *flagBindOnAdvertise, realClock{})
+	ctx, cancel := context.WithCancel(context.Background())
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, restartSignal)
+	// restarting is only read once the controller stopped running
+	var restarting bool
+	go func() {
+		sig := <-sigs
+		restarting = sig == restartSignal
+		log.WithFields(log.Fields{
+			"signal":     sig,
+			"restarting": restarting,
+		}).Info("Shutting down")
+		cancel()
+	}()
+	controller.Run(ctx, healthCheckInterval)
+	shutdown(bgp, controller, destinations, device, restarting)
+	notifications.Stop()
+}
+
+// ipvsSyncSetup starts the ipvs connection sync daemons in the namespace of the
+// ipvs services and keeps them running
+func ipvsSyncSetup(lb LoadBalancer, netns string, syncConfig *ipvsSyncConfig) {
+	if err := validateIPVSSyncConfig(syncConfig); err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Fatal("Invalid ipvs sync config")
+	}
+	daemons := toIPVSSyncDaemons(syncConfig)
+	if err := ensureIPVSSyncDaemons(lb, netns, daemons); err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Fatal("Cannot start ipvs sync daemons")
 	}
+	go watchIPVSSyncDaemons(lb, netns, daemons, *flagIPVSInterval)
 }
 
-func ServiceOn(bgp *BgpServer, config *config) {
-	if err := bgp.AddV4Path(
-		config.Service.IP,
-		config.Service.PrefixLength,
-		config.Bgp.Local.RouterId,
-	); err != nil {
-		log.Fatal(err)
+// shutdown withdraws the service path, stops the bgp server and removes the
+// host resources before the process exits, unless the path is kept for a
+// graceful restart
+func shutdown(bgp *BgpServer, controller *ServiceController, destinations *destinationPool, device *serviceDevice, restarting bool) {
+	if controller.Shutdown(restarting) {
+		return
+	}
+	if err := bgp.Stop(); err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Warn("Cannot stop bgp server")
+	}
+	if device == nil {
+		return
+	}
+	// Stop restoring the address and the ipvs services before removing them
+	device.Release()
+	if err := destinations.Deactivate(); err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Warn("Cannot delete ipvs services")
+	}
+	if err := hostRecord.Teardown(); err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Warn("Cannot remove host resources")
 	}
-	bgp.ListV4Paths()
-	advertised = true
-	log.Info("Service on")
 }
 
-func ServiceOff(bgp *BgpServer, config *config) {
-	if err := bgp.DeleteV4Path(
-		config.Service.IP,
-		config.Service.PrefixLength,
-		config.Bgp.Local.RouterId,
-	); err != nil {
-		log.Fatal(err)
+// cleanup removes the host resources recorded in the state file, left behind
+// by a process that did not shut down cleanly
+func cleanup() {
+	state, err := loadHostState(*flagStateFile, netlinkHost{}, ipvsLoadBalancer{})
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Fatal("Cannot load host state")
+	}
+	if err := state.Teardown(); err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Fatal("Cannot remove host resources")
 	}
-	bgp.ListV4Paths()
-	advertised = false
-	log.Info("Service off")
+	log.Info("Removed host resources")
 }
@@ -1,8 +1,16 @@
 package main
 
 import (
+	"fmt"
+	"maps"
 	"net/http"
+	"runtime"
+	"slices"
+	"sync"
+	"time"
 
+	libipvs "github.com/moby/ipvs"
+	"github.com/osrg/gobgp/v4/api"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	log "github.com/sirupsen/logrus"
@@ -19,10 +27,376 @@ var (
 			"next_hop",
 		},
 	)
+	bgpPathPeerAdvertisement = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "bgp_lb_path_peer_advertisement",
+		Help: "Info about whether a path has been sent to an established bgp peer. It can be 0 or 1.",
+	},
+		[]string{
+			"prefix",
+			"prefix_length",
+			"next_hop",
+			"peer",
+		},
+	)
+	bfdSessionState = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "bgp_lb_bfd_session_state",
+		Help: "The state of the bfd session toward a bgp peer. 0: AdminDown, 1: Down, 2: Init, 3: Up.",
+	},
+		[]string{
+			"peer",
+		},
+	)
+	bgpPeerSessionState = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "bgp_lb_bgp_peer_session_state",
+		Help: "The session state of a bgp peer. 1: Idle, 2: Connect, 3: Active, 4: OpenSent, 5: OpenConfirm, 6: Established.",
+	},
+		[]string{
+			"peer",
+		},
+	)
+	bgpPeerUptime = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "bgp_lb_bgp_peer_uptime_seconds",
+		Help: "Time since the session with a bgp peer got established. It is 0 while the session is not established.",
+	},
+		[]string{
+			"peer",
+		},
+	)
+	bgpPeerCounters         = newBGPPeerCountersCollector()
+	bgpPeerAcceptedPrefixes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "bgp_lb_bgp_peer_accepted_prefixes",
+		Help: "Number of ipv4 prefixes accepted from a bgp peer.",
+	},
+		[]string{
+			"peer",
+		},
+	)
+	bgpPeerAdvertisedPrefixes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "bgp_lb_bgp_peer_advertised_prefixes",
+		Help: "Number of ipv4 prefixes advertised to a bgp peer.",
+	},
+		[]string{
+			"peer",
+		},
+	)
+	ipvsServiceStatsCollector        = newIPVSStatsCollector("service", ipvsServiceLabels)
+	ipvsDestinationStatsCollector    = newIPVSStatsCollector("destination", ipvsDestinationLabels)
+	ipvsDestinationActiveConnections = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "bgp_lb_ipvs_destination_active_connections",
+		Help: "Number of active connections to an ipvs destination.",
+	},
+		ipvsDestinationLabels,
+	)
+	ipvsDestinationInactiveConnections = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "bgp_lb_ipvs_destination_inactive_connections",
+		Help: "Number of inactive connections to an ipvs destination.",
+	},
+		ipvsDestinationLabels,
+	)
+	ipvsDraining = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "bgp_lb_ipvs_draining",
+		Help: "Info about whether the ipvs destinations of a service are being drained. It can be 0 or 1.",
+	},
+		[]string{
+			"service",
+		},
+	)
+	ipvsDrainActiveConnections = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "bgp_lb_ipvs_drain_active_connections",
+		Help: "Number of active connections left to the ipvs destinations of a service during the last drain.",
+	},
+		[]string{
+			"service",
+		},
+	)
+	// ipvsDestinationMetricLabels holds the label sets of the exported ipvs
+	// destinations, so that the ones removed from ipvs can be deleted
+	ipvsDestinationMetricLabels = map[string]prometheus.Labels{}
+)
+
+var (
+	ipvsServiceLabels     = []string{"service", "vip", "protocol", "port"}
+	ipvsDestinationLabels = []string{"service", "vip", "protocol", "port", "destination"}
+)
+
+// bgpPeerCountersCollector exports the cumulative session counters that gobgp
+// keeps for the bgp peers as counters
+type bgpPeerCountersCollector struct {
+	flaps            *prometheus.Desc
+	messagesSent     *prometheus.Desc
+	messagesReceived *prometheus.Desc
+
+	mu    sync.Mutex
+	peers map[string]*bgpPeerCounterValues
+}
+
+// bgpPeerCounterValues holds the last counters listed for a bgp peer
+type bgpPeerCounterValues struct {
+	flaps    uint32
+	sent     *api.Message
+	received *api.Message
+}
+
+func newBGPPeerCountersCollector() *bgpPeerCountersCollector {
+	return &bgpPeerCountersCollector{
+		flaps: prometheus.NewDesc(
+			"bgp_lb_bgp_peer_flaps_total",
+			"Number of times the session with a bgp peer went down after being established.",
+			[]string{"peer"}, nil,
+		),
+		messagesSent: prometheus.NewDesc(
+			"bgp_lb_bgp_peer_messages_sent_total",
+			"Number of bgp messages sent to a peer by type.",
+			[]string{"peer", "type"}, nil,
+		),
+		messagesReceived: prometheus.NewDesc(
+			"bgp_lb_bgp_peer_messages_received_total",
+			"Number of bgp messages received from a peer by type.",
+			[]string{"peer", "type"}, nil,
+		),
+		peers: map[string]*bgpPeerCounterValues{},
+	}
+}
+
+func (c *bgpPeerCountersCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.flaps
+	ch <- c.messagesSent
+	ch <- c.messagesReceived
+}
+
+func (c *bgpPeerCountersCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for peer, v := range c.peers {
+		ch <- prometheus.MustNewConstMetric(c.flaps, prometheus.CounterValue, float64(v.flaps), peer)
+		for desc, msg := range map[*prometheus.Desc]*api.Message{
+			c.messagesSent:     v.sent,
+			c.messagesReceived: v.received,
+		} {
+			if msg == nil {
+				continue
+			}
+			for msgType, count := range map[string]uint64{
+				"open":         msg.Open,
+				"update":       msg.Update,
+				"notification": msg.Notification,
+				"keepalive":    msg.Keepalive,
+				"refresh":      msg.Refresh,
+			} {
+				ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, float64(count), peer, msgType)
+			}
+		}
+	}
+}
+
+// peer returns the counters of a peer, adding them if missing. It must be
+// called with the lock held.
+func (c *bgpPeerCountersCollector) peer(peer string) *bgpPeerCounterValues {
+	v, ok := c.peers[peer]
+	if !ok {
+		v = &bgpPeerCounterValues{}
+		c.peers[peer] = v
+	}
+	return v
+}
+
+func (c *bgpPeerCountersCollector) setFlaps(peer string, flaps uint32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.peer(peer).flaps = flaps
+}
+
+func (c *bgpPeerCountersCollector) setMessages(peer string, sent, received *api.Message) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	v := c.peer(peer)
+	v.sent, v.received = sent, received
+}
+
+// ipvsStatsCollector exports the traffic stats that ipvs keeps for both
+// services and destinations. The cumulative kernel counters are exported as
+// counters and the kernel rate estimations as gauges. Only the last set stats
+// are exported, so that the services and destinations removed from ipvs are
+// no longer exported.
+type ipvsStatsCollector struct {
+	labels         []string
+	connections    *prometheus.Desc
+	packets        *prometheus.Desc
+	bytes          *prometheus.Desc
+	connectionRate *prometheus.Desc
+	packetRate     *prometheus.Desc
+	byteRate       *prometheus.Desc
+
+	mu      sync.Mutex
+	samples []ipvsStatsSample
+}
+
+// ipvsStatsSample holds the stats of an ipvs service or destination and the
+// values of its labels
+type ipvsStatsSample struct {
+	labelValues []string
+	stats       libipvs.SvcStats
+}
+
+func newIPVSStatsCollector(kind string, labels []string) *ipvsStatsCollector {
+	directionLabels := append(slices.Clone(labels), "direction")
+	return &ipvsStatsCollector{
+		labels: labels,
+		connections: prometheus.NewDesc(
+			fmt.Sprintf("bgp_lb_ipvs_%s_connections_total", kind),
+			fmt.Sprintf("Number of connections scheduled by an ipvs %s.", kind),
+			labels, nil,
+		),
+		packets: prometheus.NewDesc(
+			fmt.Sprintf("bgp_lb_ipvs_%s_packets_total", kind),
+			fmt.Sprintf("Number of packets of an ipvs %s by direction.", kind),
+			directionLabels, nil,
+		),
+		bytes: prometheus.NewDesc(
+			fmt.Sprintf("bgp_lb_ipvs_%s_bytes_total", kind),
+			fmt.Sprintf("Number of bytes of an ipvs %s by direction.", kind),
+			directionLabels, nil,
+		),
+		connectionRate: prometheus.NewDesc(
+			fmt.Sprintf("bgp_lb_ipvs_%s_connections_per_second", kind),
+			fmt.Sprintf("Rate of connections scheduled by an ipvs %s, as estimated by the kernel.", kind),
+			labels, nil,
+		),
+		packetRate: prometheus.NewDesc(
+			fmt.Sprintf("bgp_lb_ipvs_%s_packets_per_second", kind),
+			fmt.Sprintf("Rate of packets of an ipvs %s by direction, as estimated by the kernel.", kind),
+			directionLabels, nil,
+		),
+		byteRate: prometheus.NewDesc(
+			fmt.Sprintf("bgp_lb_ipvs_%s_bytes_per_second", kind),
+			fmt.Sprintf("Rate of bytes of an ipvs %s by direction, as estimated by the kernel.", kind),
+			directionLabels, nil,
+		),
+	}
+}
+
+func (c *ipvsStatsCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{c.connections, c.packets, c.bytes, c.connectionRate, c.packetRate, c.byteRate} {
+		ch <- d
+	}
+}
+
+func (c *ipvsStatsCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, s := range c.samples {
+		ch <- prometheus.MustNewConstMetric(c.connections, prometheus.CounterValue, float64(s.stats.Connections), s.labelValues...)
+		ch <- prometheus.MustNewConstMetric(c.connectionRate, prometheus.GaugeValue, float64(s.stats.CPS), s.labelValues...)
+		for direction, v := range map[string][4]float64{
+			"in":  {float64(s.stats.PacketsIn), float64(s.stats.BytesIn), float64(s.stats.PPSIn), float64(s.stats.BPSIn)},
+			"out": {float64(s.stats.PacketsOut), float64(s.stats.BytesOut), float64(s.stats.PPSOut), float64(s.stats.BPSOut)},
+		} {
+			labelValues := append(slices.Clone(s.labelValues), direction)
+			ch <- prometheus.MustNewConstMetric(c.packets, prometheus.CounterValue, v[0], labelValues...)
+			ch <- prometheus.MustNewConstMetric(c.bytes, prometheus.CounterValue, v[1], labelValues...)
+			ch <- prometheus.MustNewConstMetric(c.packetRate, prometheus.GaugeValue, v[2], labelValues...)
+			ch <- prometheus.MustNewConstMetric(c.byteRate, prometheus.GaugeValue, v[3], labelValues...)
+		}
+	}
+}
+
+// sample returns the sample of the stats with the given labels
+func (c *ipvsStatsCollector) sample(labels prometheus.Labels, stats libipvs.SvcStats) ipvsStatsSample {
+	values := make([]string, len(c.labels))
+	for i, l := range c.labels {
+		values[i] = labels[l]
+	}
+	return ipvsStatsSample{labelValues: values, stats: stats}
+}
+
+// set replaces the exported stats
+func (c *ipvsStatsCollector) set(samples []ipvsStatsSample) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.samples = samples
+}
+
+var (
+	healthCheckDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "bgp_lb_healthcheck_duration_seconds",
+		Help:    "Duration of the service healthchecks.",
+		Buckets: []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+	},
+		[]string{
+			"service",
+			"check",
+		},
+	)
+	healthCheckResults = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "bgp_lb_healthcheck_results_total",
+		Help: "Number of service healthchecks by result. It can be success, failure or error.",
+	},
+		[]string{
+			"service",
+			"check",
+			"result",
+		},
+	)
+	serviceTransitions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "bgp_lb_service_transitions_total",
+		Help: "Number of times the service path was advertised or withdrawn, by reason.",
+	},
+		[]string{
+			"service",
+			"transition",
+			"reason",
+		},
+	)
+	serviceLastTransition = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "bgp_lb_service_last_transition_timestamp_seconds",
+		Help: "Time of the last advertisement or withdrawal of the service path, in seconds since the epoch.",
+	},
+		[]string{
+			"service",
+		},
+	)
+	buildInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "bgp_lb_build_info",
+		Help: "Build information and hash of the loaded config file. It is always 1.",
+	},
+		[]string{
+			"version",
+			"go_version",
+			"config_hash",
+		},
+	)
+	webhookEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "bgp_lb_webhook_events_total",
+		Help: "Number of events sent to a webhook by result. It can be delivered, failed or dropped.",
+	},
+		[]string{
+			"webhook",
+			"result",
+		},
+	)
 )
 
 func init() {
 	prometheus.MustRegister(bgpPathAdvertisement)
+	prometheus.MustRegister(bgpPathPeerAdvertisement)
+	prometheus.MustRegister(bfdSessionState)
+	prometheus.MustRegister(bgpPeerSessionState)
+	prometheus.MustRegister(bgpPeerUptime)
+	prometheus.MustRegister(bgpPeerCounters)
+	prometheus.MustRegister(bgpPeerAcceptedPrefixes)
+	prometheus.MustRegister(bgpPeerAdvertisedPrefixes)
+	prometheus.MustRegister(ipvsServiceStatsCollector)
+	prometheus.MustRegister(ipvsDestinationStatsCollector)
+	prometheus.MustRegister(ipvsDestinationActiveConnections)
+	prometheus.MustRegister(ipvsDestinationInactiveConnections)
+	prometheus.MustRegister(ipvsDraining)
+	prometheus.MustRegister(ipvsDrainActiveConnections)
+	prometheus.MustRegister(healthCheckDuration)
+	prometheus.MustRegister(healthCheckResults)
+	prometheus.MustRegister(serviceTransitions)
+	prometheus.MustRegister(serviceLastTransition)
+	prometheus.MustRegister(buildInfo)
+	prometheus.MustRegister(webhookEvents)
 }
 
 func setBGPPathAdvertisementMetric(prefix, prefixLen, nexthop string) {
@@ -41,7 +415,168 @@ func unsetBGPPathAdvertisementMetric(prefix, prefixLen, nexthop string) {
 	}).Set(0)
 }
 
+func setBGPPathPeerAdvertisementMetric(prefix, prefixLen, nexthop, peer string, advertised bool) {
+	value := 0.0
+	if advertised {
+		value = 1
+	}
+	bgpPathPeerAdvertisement.With(prometheus.Labels{
+		"prefix":        prefix,
+		"prefix_length": prefixLen,
+		"next_hop":      nexthop,
+		"peer":          peer,
+	}).Set(value)
+}
+
+func setBFDSessionStateMetric(peer string, state bfdState) {
+	bfdSessionState.With(prometheus.Labels{
+		"peer": peer,
+	}).Set(float64(state))
+}
+
+func setBGPPeerSessionStateMetric(peer string, state api.PeerState_SessionState) {
+	bgpPeerSessionState.With(prometheus.Labels{
+		"peer": peer,
+	}).Set(float64(state))
+}
+
+func setBGPPeerUptimeMetric(peer string, uptime time.Duration) {
+	bgpPeerUptime.With(prometheus.Labels{
+		"peer": peer,
+	}).Set(uptime.Seconds())
+}
+
+func setBGPPeerFlapsMetric(peer string, flaps uint32) {
+	bgpPeerCounters.setFlaps(peer, flaps)
+}
+
+func setBGPPeerMessagesMetrics(peer string, sent, received *api.Message) {
+	bgpPeerCounters.setMessages(peer, sent, received)
+}
+
+func setBGPPeerPrefixesMetrics(peer string, accepted, advertised uint64) {
+	bgpPeerAcceptedPrefixes.With(prometheus.Labels{
+		"peer": peer,
+	}).Set(float64(accepted))
+	bgpPeerAdvertisedPrefixes.With(prometheus.Labels{
+		"peer": peer,
+	}).Set(float64(advertised))
+}
+
+// ipvsServiceMetricLabels returns the labels of an ipvs service. Fwmark
+// services match multiple protocols and ports, which are left empty.
+func ipvsServiceMetricLabels(name, vip string, svc *libipvs.Service) prometheus.Labels {
+	labels := prometheus.Labels{
+		"service":  name,
+		"vip":      vip,
+		"protocol": "",
+		"port":     "",
+	}
+	if svc.FWMark == 0 {
+		labels["protocol"] = protocolToString(svc.Protocol)
+		labels["port"] = fmt.Sprint(svc.Port)
+	}
+	return labels
+}
+
+// setIPVSStatsMetrics exports the stats of the ipvs services and destinations,
+// replacing the previous ones
+func setIPVSStatsMetrics(name, vip string, stats []ipvsServiceStats) {
+	seen := map[string]bool{}
+	var svcSamples, destSamples []ipvsStatsSample
+	for _, s := range stats {
+		svcLabels := ipvsServiceMetricLabels(name, vip, s.service)
+		svcSamples = append(svcSamples, ipvsServiceStatsCollector.sample(svcLabels, libipvs.SvcStats(s.service.Stats)))
+		for _, d := range s.destinations {
+			labels := maps.Clone(svcLabels)
+			labels["destination"] = ipvsDestinationKey(d)
+			key := fmt.Sprintf("%s/%s", ipvsServiceKey(s.service), labels["destination"])
+			seen[key] = true
+			ipvsDestinationMetricLabels[key] = labels
+			destSamples = append(destSamples, ipvsDestinationStatsCollector.sample(labels, libipvs.SvcStats(d.Stats)))
+			ipvsDestinationActiveConnections.With(labels).Set(float64(d.ActiveConnections))
+			ipvsDestinationInactiveConnections.With(labels).Set(float64(d.InactiveConnections))
+		}
+	}
+	ipvsServiceStatsCollector.set(svcSamples)
+	ipvsDestinationStatsCollector.set(destSamples)
+	// Delete the connection metrics of the destinations removed from ipvs
+	for key, labels := range ipvsDestinationMetricLabels {
+		if seen[key] {
+			continue
+		}
+		ipvsDestinationActiveConnections.Delete(labels)
+		ipvsDestinationInactiveConnections.Delete(labels)
+		delete(ipvsDestinationMetricLabels, key)
+	}
+}
+
+func setIPVSDrainingMetric(service string, draining bool) {
+	value := 0.0
+	if draining {
+		value = 1
+	}
+	ipvsDraining.With(prometheus.Labels{
+		"service": service,
+	}).Set(value)
+}
+
+func setIPVSDrainActiveConnectionsMetric(service string, active int) {
+	ipvsDrainActiveConnections.With(prometheus.Labels{
+		"service": service,
+	}).Set(float64(active))
+}
+
+// observeHealthCheckMetrics records the duration and the result of a service
+// healthcheck
+func observeHealthCheckMetrics(service, check string, res Result, duration time.Duration) {
+	healthCheckDuration.With(prometheus.Labels{
+		"service": service,
+		"check":   check,
+	}).Observe(duration.Seconds())
+	result := "failure"
+	if res.healthy {
+		result = "success"
+	} else if res.err != "" {
+		result = "error"
+	}
+	healthCheckResults.With(prometheus.Labels{
+		"service": service,
+		"check":   check,
+		"result":  result,
+	}).Inc()
+}
+
+func setServiceTransitionMetrics(service, transition, reason string, at time.Time) {
+	serviceTransitions.With(prometheus.Labels{
+		"service":    service,
+		"transition": transition,
+		"reason":     reason,
+	}).Inc()
+	serviceLastTransition.With(prometheus.Labels{
+		"service": service,
+	}).Set(float64(at.UnixNano()) / 1e9)
+}
+
+func setBuildInfoMetric(version, configHash string) {
+	buildInfo.With(prometheus.Labels{
+		"version":     version,
+		"go_version":  runtime.Version(),
+		"config_hash": configHash,
+	}).Set(1)
+}
+
+func addWebhookEventsMetric(webhook, result string, events int) {
+	webhookEvents.With(prometheus.Labels{
+		"webhook": webhook,
+		"result":  result,
+	}).Add(float64(events))
+}
+
 func startMetricsServer(listenAddress string) {
 	http.Handle("/metrics", promhttp.Handler())
-	log.Fatal(http.ListenAndServe(listenAddress, nil))
+	err := http.ListenAndServe(listenAddress, nil)
+	log.WithFields(log.Fields{
+		"error": err,
+	}).Fatal("Metrics server failed")
 }
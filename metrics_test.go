@@ -0,0 +1,80 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	libipvs "github.com/moby/ipvs"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetIPVSStatsMetrics(t *testing.T) {
+	svc := toIPVSService("10.88.2.1", "tcp", 80, nil)
+	svc.Stats = libipvs.SvcStats{Connections: 10, PacketsIn: 100, BytesOut: 2000}
+	dest := toIPVSDestination("10.88.0.200", 8080, "", nil)
+	dest.ActiveConnections = 3
+	dest.Stats = libipvs.DstStats{Connections: 10}
+	setIPVSStatsMetrics("test", "10.88.2.1", []ipvsServiceStats{{service: svc, destinations: []*libipvs.Destination{dest}}})
+
+	// Cumulative kernel counters are exported as counters
+	expected := `
+# HELP bgp_lb_ipvs_service_connections_total Number of connections scheduled by an ipvs service.
+# TYPE bgp_lb_ipvs_service_connections_total counter
+bgp_lb_ipvs_service_connections_total{port="80",protocol="tcp",service="test",vip="10.88.2.1"} 10
+# HELP bgp_lb_ipvs_service_packets_total Number of packets of an ipvs service by direction.
+# TYPE bgp_lb_ipvs_service_packets_total counter
+bgp_lb_ipvs_service_packets_total{direction="in",port="80",protocol="tcp",service="test",vip="10.88.2.1"} 100
+bgp_lb_ipvs_service_packets_total{direction="out",port="80",protocol="tcp",service="test",vip="10.88.2.1"} 0
+# HELP bgp_lb_ipvs_service_bytes_total Number of bytes of an ipvs service by direction.
+# TYPE bgp_lb_ipvs_service_bytes_total counter
+bgp_lb_ipvs_service_bytes_total{direction="in",port="80",protocol="tcp",service="test",vip="10.88.2.1"} 0
+bgp_lb_ipvs_service_bytes_total{direction="out",port="80",protocol="tcp",service="test",vip="10.88.2.1"} 2000
+`
+	assert.NoError(t, testutil.CollectAndCompare(ipvsServiceStatsCollector, strings.NewReader(expected),
+		"bgp_lb_ipvs_service_connections_total", "bgp_lb_ipvs_service_packets_total", "bgp_lb_ipvs_service_bytes_total"))
+	assert.Equal(t, 1, testutil.CollectAndCount(ipvsDestinationStatsCollector, "bgp_lb_ipvs_destination_connections_total"))
+	destLabels := prometheus.Labels{"service": "test", "vip": "10.88.2.1", "protocol": "tcp", "port": "80", "destination": "10.88.0.200:8080"}
+	assert.Equal(t, 3.0, testutil.ToFloat64(ipvsDestinationActiveConnections.With(destLabels)))
+
+	// Removed destinations are no longer exported
+	setIPVSStatsMetrics("test", "10.88.2.1", []ipvsServiceStats{{service: svc}})
+	assert.Equal(t, 0, testutil.CollectAndCount(ipvsDestinationActiveConnections))
+	assert.Equal(t, 0, testutil.CollectAndCount(ipvsDestinationStatsCollector))
+	assert.Equal(t, 1, testutil.CollectAndCount(ipvsServiceStatsCollector, "bgp_lb_ipvs_service_connections_total"))
+
+	// Neither are removed services
+	setIPVSStatsMetrics("test", "10.88.2.1", nil)
+	assert.Equal(t, 0, testutil.CollectAndCount(ipvsServiceStatsCollector))
+}
+
+func TestObserveHealthCheckMetrics(t *testing.T) {
+	observeHealthCheckMetrics("metrics-test", "http", Result{healthy: true}, 20*time.Millisecond)
+	observeHealthCheckMetrics("metrics-test", "http", Result{err: "timeout"}, time.Second)
+	observeHealthCheckMetrics("metrics-test", "http", Result{output: "503"}, 50*time.Millisecond)
+
+	for _, result := range []string{"success", "failure", "error"} {
+		assert.Equal(t, 1.0, testutil.ToFloat64(healthCheckResults.With(prometheus.Labels{
+			"service": "metrics-test",
+			"check":   "http",
+			"result":  result,
+		})), result)
+	}
+	m := &dto.Metric{}
+	assert.NoError(t, healthCheckDuration.WithLabelValues("metrics-test", "http").(prometheus.Metric).Write(m))
+	assert.Equal(t, uint64(3), m.GetHistogram().GetSampleCount())
+	assert.InDelta(t, 1.07, m.GetHistogram().GetSampleSum(), 1e-9)
+}
+
+func TestSetServiceTransitionMetrics(t *testing.T) {
+	setServiceTransitionMetrics("metrics-test", "withdraw", reasonHealthCheckFailed, time.Unix(1700000000, 500000000))
+	assert.Equal(t, 1.0, testutil.ToFloat64(serviceTransitions.With(prometheus.Labels{
+		"service":    "metrics-test",
+		"transition": "withdraw",
+		"reason":     reasonHealthCheckFailed,
+	})))
+	assert.Equal(t, 1700000000.5, testutil.ToFloat64(serviceLastTransition.WithLabelValues("metrics-test")))
+}
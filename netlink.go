@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"net"
 	"syscall"
 
@@ -8,33 +9,101 @@ import (
 	"github.com/vishvananda/netlink"
 )
 
-// ensureServiceDevice looks for a device of the given name and creates a dummy
-// one if not found
-func ensureServiceDevice(name string) error {
-	h := netlink.Handle{}
+const (
+	// ownedAddressLabelSuffix is appended to the device name to label the
+	// addresses added by bgp-lb
+	ownedAddressLabelSuffix = ":lb"
+	// maxAddressLabelLength is the longest address label, as IFNAMSIZ is 16
+	// including the null termination
+	maxAddressLabelLength = 15
+)
+
+// HostNetwork manages the service devices and addresses in the network
+// namespaces of the host. An empty netns is the current namespace.
+type HostNetwork interface {
+	// EnsureDevice looks for a device of the given name and creates a dummy
+	// one if not found and create is set. It returns whether the device was
+	// created.
+	EnsureDevice(netns, name string, create bool) (bool, error)
+	// DeleteDevice deletes a dummy device, if it exists
+	DeleteDevice(netns, name string) error
+	// SetDeviceVRF enslaves a device to a vrf device
+	SetDeviceVRF(netns, device, vrf string) error
+	// FlushIPv4Addresses deletes all the ipv4 addresses from a dummy device
+	FlushIPv4Addresses(netns, device string) error
+	// DeleteOwnedAddresses deletes the ipv4 addresses labelled as owned by
+	// bgp-lb from a device, except the given ip
+	DeleteOwnedAddresses(netns, device, keepIP string) error
+	// AddAddress adds an ip address to a device, labelled as owned by bgp-lb,
+	// and returns whether the address is owned. An existing address that is
+	// not labelled as owned is left untouched.
+	AddAddress(netns, ip, device string, prefixLength int) (bool, error)
+	// DeleteAddress deletes an ip address from a device, if present
+	DeleteAddress(netns, ip, device string, prefixLength int) error
+	// HasAddress checks whether a device exists and has the given ip address
+	HasAddress(netns, ip, device string) (bool, error)
+}
+
+// netlinkHost is the HostNetwork of the kernel, managed via netlink
+type netlinkHost struct{}
+
+func (netlinkHost) EnsureDevice(netns, name string, create bool) (bool, error) {
+	h, err := netlinkHandle(netns)
+	if err != nil {
+		return false, err
+	}
 	defer h.Close()
-	_, err := h.LinkByName(name)
+	_, err = h.LinkByName(name)
 	if err != nil {
 		_, notFound := err.(netlink.LinkNotFoundError)
-		if notFound {
+		if notFound && create {
 			d := &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{
 				Name: name,
 			}}
-			return netlink.LinkAdd(d)
+			if err := h.LinkAdd(d); err != nil {
+				return false, err
+			}
+			return true, nil
 		}
+		return false, err
+	}
+	return false, nil
+}
+
+func (netlinkHost) DeleteDevice(netns, name string) error {
+	h, err := netlinkHandle(netns)
+	if err != nil {
 		return err
 	}
-	return nil
+	defer h.Close()
+	link, err := h.LinkByName(name)
+	if err != nil {
+		if _, notFound := err.(netlink.LinkNotFoundError); notFound {
+			return nil
+		}
+		return err
+	}
+	if link.Type() != "dummy" {
+		return fmt.Errorf("refusing to delete %s link %s", link.Type(), name)
+	}
+	return h.LinkDel(link)
 }
 
-// flushIPv4Addresses deletes all the ipv4 addresses from a device
-func flushIPv4Addresses(device string) error {
-	h := netlink.Handle{}
+// FlushIPv4Addresses refuses to flush non dummy links, as they are likely
+// shared with other services
+func (netlinkHost) FlushIPv4Addresses(netns, device string) error {
+	h, err := netlinkHandle(netns)
+	if err != nil {
+		return err
+	}
 	defer h.Close()
 	link, err := h.LinkByName(device)
 	if err != nil {
 		return err
 	}
+	if link.Type() != "dummy" {
+		return fmt.Errorf("refusing to flush addresses of %s link %s", link.Type(), device)
+	}
 	addrs, err := h.AddrList(link, syscall.AF_INET)
 	if err != nil {
 		return err
@@ -47,66 +116,340 @@ func flushIPv4Addresses(device string) error {
 	return nil
 }
 
-// addAddressToDevice adds an ip address to a device
-func addAddressToDevice(ip, device string, prefixLength int) error {
-	h := netlink.Handle{}
+func (netlinkHost) DeleteOwnedAddresses(netns, device, keepIP string) error {
+	label := ownedAddressLabel(device)
+	h, err := netlinkHandle(netns)
+	if err != nil {
+		return err
+	}
 	defer h.Close()
 	link, err := h.LinkByName(device)
 	if err != nil {
 		return err
 	}
+	addrs, err := h.AddrList(link, syscall.AF_INET)
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		if addr.Label != label || addr.IP.Equal(net.ParseIP(keepIP)) {
+			continue
+		}
+		if err := h.AddrDel(link, &addr); err != nil {
+			return err
+		}
+		log.WithFields(log.Fields{
+			"device":  device,
+			"address": addr.IPNet.String(),
+		}).Info("Deleted stale service address")
+	}
+	return nil
+}
+
+func (netlinkHost) AddAddress(netns, ip, device string, prefixLength int) (bool, error) {
+	h, err := netlinkHandle(netns)
+	if err != nil {
+		return false, err
+	}
+	defer h.Close()
+	link, err := h.LinkByName(device)
+	if err != nil {
+		return false, err
+	}
+	label := ownedAddressLabel(device)
 	ipv4Addr := net.ParseIP(ip)
+	addrs, err := h.AddrList(link, netlink.FAMILY_V4)
+	if err != nil {
+		return false, err
+	}
+	for _, a := range addrs {
+		if a.IP.Equal(ipv4Addr) && a.Label != label {
+			return false, nil
+		}
+	}
 	ipv4Mask := net.CIDRMask(prefixLength, 32)
-	return h.AddrAdd(link, &netlink.Addr{
+	return true, h.AddrReplace(link, &netlink.Addr{
 		IPNet: &net.IPNet{
 			IP:   ipv4Addr,
 			Mask: ipv4Mask,
 		},
+		Label: label,
+	})
+}
+
+func (netlinkHost) SetDeviceVRF(netns, device, vrf string) error {
+	h, err := netlinkHandle(netns)
+	if err != nil {
+		return err
+	}
+	defer h.Close()
+	link, err := h.LinkByName(device)
+	if err != nil {
+		return err
+	}
+	master, err := h.LinkByName(vrf)
+	if err != nil {
+		return fmt.Errorf("cannot find vrf %s: %v", vrf, err)
+	}
+	if master.Type() != "vrf" {
+		return fmt.Errorf("%s is a %s link, not a vrf", vrf, master.Type())
+	}
+	if link.Attrs().MasterIndex == master.Attrs().Index {
+		return nil
+	}
+	return h.LinkSetMasterByIndex(link, master.Attrs().Index)
+}
+
+func (n netlinkHost) DeleteAddress(netns, ip, device string, prefixLength int) error {
+	present, err := n.HasAddress(netns, ip, device)
+	if err != nil || !present {
+		return err
+	}
+	h, err := netlinkHandle(netns)
+	if err != nil {
+		return err
+	}
+	defer h.Close()
+	link, err := h.LinkByName(device)
+	if err != nil {
+		return err
+	}
+	return h.AddrDel(link, &netlink.Addr{
+		IPNet: &net.IPNet{
+			IP:   net.ParseIP(ip),
+			Mask: net.CIDRMask(prefixLength, 32),
+		},
 	})
 }
 
+func (netlinkHost) HasAddress(netns, ip, device string) (bool, error) {
+	h, err := netlinkHandle(netns)
+	if err != nil {
+		return false, err
+	}
+	defer h.Close()
+	link, err := h.LinkByName(device)
+	if err != nil {
+		if _, notFound := err.(netlink.LinkNotFoundError); notFound {
+			return false, nil
+		}
+		return false, err
+	}
+	addrs, err := h.AddrList(link, syscall.AF_INET)
+	if err != nil {
+		return false, err
+	}
+	for _, addr := range addrs {
+		if addr.IP.Equal(net.ParseIP(ip)) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// ownedAddressLabel returns the label of the addresses owned by bgp-lb on a
+// device. Labels must start with the device name, so names too long for the
+// suffix get the default label, the device name. Only the dummy devices of
+// bgp-lb, whose addresses are all owned, can have such names, see
+// validateSharedDevice.
+func ownedAddressLabel(device string) string {
+	if len(device)+len(ownedAddressLabelSuffix) > maxAddressLabelLength {
+		return device
+	}
+	return device + ownedAddressLabelSuffix
+}
+
+// validateSharedDevice checks that the name of a configured device is short
+// enough to label the owned addresses
+func validateSharedDevice(device string) error {
+	if maxLength := maxAddressLabelLength - len(ownedAddressLabelSuffix); len(device) > maxLength {
+		return fmt.Errorf("device name %s is longer than %d characters", device, maxLength)
+	}
+	return nil
+}
+
+// ensureServiceDevice ensures the service device exists and records it when
+// created by bgp-lb
+func ensureServiceDevice(host HostNetwork, netns, name string, create bool) error {
+	created, err := host.EnsureDevice(netns, name, create)
+	if err != nil {
+		return err
+	}
+	if created {
+		hostRecord.RecordDevice(netns, name)
+	}
+	return nil
+}
+
+// addServiceAddress adds the service address to a device and records it,
+// unless it was configured by others
+func addServiceAddress(host HostNetwork, netns, ip, device string, prefixLength int) error {
+	owned, err := host.AddAddress(netns, ip, device, prefixLength)
+	if err != nil {
+		return err
+	}
+	if owned {
+		hostRecord.RecordAddress(netns, device, ip, prefixLength)
+	}
+	return nil
+}
+
 // netlinkSetup applies the needed host network configuration based on the
-// service config
-func netlinkSetup(serviceConfig serviceConfig, localIP string, setupIPVS bool) {
-	// Ensure the dummy device exists
-	if err := ensureServiceDevice(serviceConfig.Name); err != nil {
+// service config. It returns the pool of the desired ipvs services and
+// destinations, which is empty unless ipvs setup is required.
+func netlinkSetup(host HostNetwork, lb LoadBalancer, serviceConfig serviceConfig, localIP string, setupIPVS, bindOnAdvertise bool) *destinationPool {
+	pool := newDestinationPool(serviceConfig.IP, serviceConfig.Netns, lb)
+	device := serviceDeviceName(serviceConfig)
+	if serviceConfig.Device != "" {
+		if err := validateSharedDevice(device); err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+			}).Fatal("Invalid service link device")
+		}
+	}
+	// Ensure the dummy device exists, or the configured device
+	if err := ensureServiceDevice(host, serviceConfig.Netns, device, serviceConfig.Device == ""); err != nil {
 		log.WithFields(log.Fields{
-			"error": err,
+			"error":  err,
+			"device": device,
 		}).Fatal("Cannot ensure service link device")
 	}
-	// Add the service ip after cleaning all pre-existing ipv4 addresses
-	if err := flushIPv4Addresses(serviceConfig.Name); err != nil {
+	if serviceConfig.VRF != "" {
+		if err := host.SetDeviceVRF(serviceConfig.Netns, device, serviceConfig.VRF); err != nil {
+			log.WithFields(log.Fields{
+				"error":  err,
+				"device": device,
+				"vrf":    serviceConfig.VRF,
+			}).Fatal("Cannot set the vrf of the service link device")
+		}
+	}
+	// Add the service ip after cleaning the pre-existing ipv4 addresses of
+	// the dummy device. Only the addresses owned by bgp-lb are deleted from
+	// a configured device, as it may be shared.
+	var err error
+	if serviceConfig.Device == "" {
+		err = host.FlushIPv4Addresses(serviceConfig.Netns, device)
+	} else {
+		keepIP := serviceConfig.IP
+		if bindOnAdvertise {
+			keepIP = ""
+		}
+		err = host.DeleteOwnedAddresses(serviceConfig.Netns, device, keepIP)
+	}
+	if err != nil {
 		log.WithFields(log.Fields{
 			"error":  err,
-			"device": serviceConfig.Name,
+			"device": device,
 		}).Fatal("Failed to clean ipv4 addresses from device")
 	}
-	if err := addAddressToDevice(serviceConfig.IP, serviceConfig.Name, serviceConfig.PrefixLength); err != nil {
-		log.WithFields(log.Fields{
-			"error": err,
-		}).Fatal("Cannot add address to service link device")
+	// The address is added once the service is advertised, if binding on
+	// advertise
+	if !bindOnAdvertise {
+		if err := addServiceAddress(host, serviceConfig.Netns, serviceConfig.IP, device, serviceConfig.PrefixLength); err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+			}).Fatal("Cannot add address to service link device")
+		}
 	}
+	arpSuppressionSetup(serviceConfig)
 	// If setting IPVS is not required, we are done here
 	if !setupIPVS {
-		return
+		return pool
 	}
-	// Ensure ipvs service and add the local router as destination
-	if err := cleanIPVSServices(serviceConfig.IP); err != nil {
+	if err := validateIPVSConfig(serviceConfig); err != nil {
 		log.WithFields(log.Fields{
 			"error": err,
-		}).Fatal("Cannot clean existing ipvs services")
+		}).Fatal("Invalid ipvs config")
 	}
-	for _, port := range serviceConfig.Ports {
-		svc, err := addIPVSService(serviceConfig.IP, serviceConfig.Protocol, port.ServicePort)
-		if err != nil {
+	if ipvsFWMark(serviceConfig) != 0 {
+		if err := inNetns(serviceConfig.Netns, func() error { return ensureFWMarkRules(serviceConfig) }); err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+			}).Fatal("Cannot set up fwmark rules")
+		}
+		fwmarkSetup(pool, serviceConfig, localIP)
+	} else {
+		// Ensure ipvs service and add the real servers or the local router
+		// as destinations. Port ranges share the real server checks.
+		checks := realServerChecks{}
+		for _, port := range expandServicePorts(serviceConfig) {
+			svc := toIPVSService(serviceConfig.IP, port.Protocol, port.ServicePort, serviceConfig.IPVS)
+			pool.AddService(svc)
+			if len(port.RealServers) == 0 {
+				pool.Add(svc, toIPVSDestination(localIP, port.TargetPort, port.ForwardingMethod, port.Weight), nil)
+				continue
+			}
+			for _, rs := range port.RealServers {
+				pool.Add(svc, toIPVSDestination(rs.Address, rs.Port, rs.ForwardingMethod, rs.Weight), checks.Setup(rs))
+			}
+		}
+	}
+	// Likewise, the ipvs services are created once the service is advertised
+	if bindOnAdvertise {
+		if err := pool.Deactivate(); err != nil {
 			log.WithFields(log.Fields{
 				"error": err,
-			}).Fatal("Cannot add ipvs service")
+			}).Fatal("Cannot delete ipvs services")
 		}
-		if err := addIPVSDestination(svc, localIP, port.TargetPort); err != nil {
+		return pool
+	}
+	if err := pool.Reconcile(); err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Fatal("Cannot set up ipvs services")
+	}
+	return pool
+}
+
+// arpSuppressionSetup sets the arp and ndp sysctls of the service, if
+// configured, and records their previous values
+func arpSuppressionSetup(serviceConfig serviceConfig) {
+	if serviceConfig.ArpSuppression == nil {
+		return
+	}
+	values, err := arpSuppressionSysctls(serviceConfig.ArpSuppression)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Fatal("Invalid arp suppression config")
+	}
+	var previous sysctlValues
+	err = inNetns(serviceConfig.Netns, func() error {
+		previous, err = applySysctls(values.withoutDisabledIPv6())
+		return err
+	})
+	if err != nil {
+		if err := inNetns(serviceConfig.Netns, previous.Restore); err != nil {
 			log.WithFields(log.Fields{
 				"error": err,
-			}).Fatal("Cannot add ipvs service destination")
+			}).Warn("Cannot restore sysctls")
+		}
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Fatal("Cannot set arp suppression sysctls")
+	}
+	hostRecord.RecordSysctls(serviceConfig.Netns, previous)
+}
+
+// fwmarkSetup adds a single fwmark ipvs service to the pool. Destinations keep
+// the destination port of the marked traffic, so each address is added once.
+func fwmarkSetup(pool *destinationPool, serviceConfig serviceConfig, localIP string) {
+	svc := toIPVSFWMarkService(ipvsFWMark(serviceConfig), serviceConfig.IPVS)
+	pool.AddService(svc)
+	seen := map[string]bool{}
+	for _, port := range serviceConfig.Ports {
+		if len(port.RealServers) == 0 {
+			if !seen[localIP] {
+				seen[localIP] = true
+				pool.Add(svc, toIPVSDestination(localIP, 0, port.ForwardingMethod, port.Weight), nil)
+			}
+			continue
+		}
+		for _, rs := range port.RealServers {
+			if !seen[rs.Address] {
+				seen[rs.Address] = true
+				pool.Add(svc, toIPVSDestination(rs.Address, 0, rs.ForwardingMethod, rs.Weight), realServerCheckSetup(rs))
+			}
 		}
 	}
 }
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"testing"
+
+	libipvs "github.com/moby/ipvs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOwnedAddressLabel(t *testing.T) {
+	assert.Equal(t, "lo:lb", ownedAddressLabel("lo"))
+	assert.Equal(t, "ingress-ext:lb", ownedAddressLabel("ingress-ext"))
+	// Dummy devices named after long service names keep the default label
+	assert.Equal(t, "ingress-extern", ownedAddressLabel("ingress-extern"))
+}
+
+func TestValidateSharedDevice(t *testing.T) {
+	assert.NoError(t, validateSharedDevice("ingress-ext"))
+	assert.NoError(t, validateSharedDevice("ingress-exte"))
+	// The label would not fit
+	assert.Error(t, validateSharedDevice("ingress-exter"))
+}
+
+func TestServiceDeviceName(t *testing.T) {
+	assert.Equal(t, "ingress", serviceDeviceName(serviceConfig{Name: "ingress"}))
+	assert.Equal(t, "lo", serviceDeviceName(serviceConfig{Name: "ingress", Device: "lo"}))
+}
+
+func TestNetlinkSetup(t *testing.T) {
+	host, lb := newFakeHostNetwork(), newFakeLoadBalancer()
+	useHostRecord(t, host, lb)
+	sc := serviceConfig{
+		Name:         "ingress",
+		IP:           "10.88.2.1",
+		PrefixLength: 32,
+		Protocol:     "tcp",
+		Ports:        []servicePortConfig{{ServicePort: 80, TargetPort: 8080}},
+	}
+
+	pool := netlinkSetup(host, lb, sc, "10.88.0.10", true, false)
+	assert.Equal(t, &fakeLink{
+		kind:  "dummy",
+		addrs: []fakeAddr{{ip: "10.88.2.1", prefixLength: 32, label: "ingress:lb"}},
+	}, host.Link("", "ingress"))
+	svc := lb.Service("", "tcp:10.88.2.1:80")
+	if assert.NotNil(t, svc) {
+		assert.Equal(t, []libipvs.Destination{fakeDestination("10.88.0.10", 8080, 1)}, svc.destinations)
+	}
+	assert.Len(t, pool.services, 1)
+
+	// Everything set up is recorded and removed on teardown
+	assert.Len(t, hostRecord.Devices, 1)
+	assert.Len(t, hostRecord.Addresses, 1)
+	assert.Len(t, hostRecord.IPVSServices, 1)
+	assert.NoError(t, hostRecord.Teardown())
+	assert.Nil(t, host.Link("", "ingress"))
+	assert.Nil(t, lb.Service("", "tcp:10.88.2.1:80"))
+}
+
+func TestNetlinkSetupLongServiceName(t *testing.T) {
+	host, lb := newFakeHostNetwork(), newFakeLoadBalancer()
+	useHostRecord(t, host, lb)
+	sc := serviceConfig{Name: "ingress-extern", IP: "10.88.2.1", PrefixLength: 32}
+
+	// The dummy device does not need the owned label
+	netlinkSetup(host, lb, sc, "10.88.0.10", false, false)
+	assert.Equal(t, &fakeLink{
+		kind:  "dummy",
+		addrs: []fakeAddr{{ip: "10.88.2.1", prefixLength: 32, label: "ingress-extern"}},
+	}, host.Link("", "ingress-extern"))
+	assert.Len(t, hostRecord.Addresses, 1)
+}
+
+func TestNetlinkSetupSharedDevice(t *testing.T) {
+	host, lb := newFakeHostNetwork(), newFakeLoadBalancer()
+	useHostRecord(t, host, lb)
+	host.AddLink("", "lo", "loopback",
+		fakeAddr{ip: "127.0.0.1", prefixLength: 8},
+		fakeAddr{ip: "10.88.2.9", prefixLength: 32, label: "lo:lb"},
+	)
+	sc := serviceConfig{
+		Name:         "ingress",
+		Device:       "lo",
+		IP:           "10.88.2.1",
+		PrefixLength: 32,
+		Protocol:     "tcp",
+		Ports:        []servicePortConfig{{ServicePort: 80}},
+	}
+
+	// Only the stale owned address is deleted and, when binding on
+	// advertise, nothing is added until advertised
+	netlinkSetup(host, lb, sc, "10.88.0.10", true, true)
+	assert.Equal(t, []fakeAddr{{ip: "127.0.0.1", prefixLength: 8}}, host.Link("", "lo").addrs)
+	assert.Nil(t, lb.Service("", "tcp:10.88.2.1:80"))
+
+	// The shared device is not recorded, so it is kept on teardown
+	assert.Empty(t, hostRecord.Devices)
+	assert.NoError(t, hostRecord.Teardown())
+	assert.NotNil(t, host.Link("", "lo"))
+}
+
+func TestServiceDeviceReconcile(t *testing.T) {
+	host := newFakeHostNetwork()
+	host.AddLink("", "blue", "vrf")
+	d := newServiceDevice(serviceConfig{Name: "ingress", VRF: "blue", IP: "10.88.2.1", PrefixLength: 32}, true, host)
+
+	// The device is re-created in the vrf and the address restored
+	d.Reconcile()
+	assert.True(t, d.Ready())
+	assert.Equal(t, "blue", host.Link("", "ingress").vrf)
+	present, err := host.HasAddress("", "10.88.2.1", "ingress")
+	assert.NoError(t, err)
+	assert.True(t, present)
+
+	// Unbound addresses are deleted and kept deleted
+	assert.NoError(t, d.Unbind())
+	d.Reconcile()
+	present, err = host.HasAddress("", "10.88.2.1", "ingress")
+	assert.NoError(t, err)
+	assert.False(t, present)
+	assert.True(t, d.Ready())
+}
+
+func TestNetlinkSetupExistingAddress(t *testing.T) {
+	host, lb := newFakeHostNetwork(), newFakeLoadBalancer()
+	useHostRecord(t, host, lb)
+	host.AddLink("", "lo", "loopback", fakeAddr{ip: "10.88.2.1", prefixLength: 32})
+	sc := serviceConfig{
+		Name:         "ingress",
+		Device:       "lo",
+		IP:           "10.88.2.1",
+		PrefixLength: 32,
+	}
+
+	// The address configured by the operator is neither relabelled nor
+	// recorded, so it is kept on teardown
+	netlinkSetup(host, lb, sc, "10.88.0.10", false, false)
+	assert.Equal(t, []fakeAddr{{ip: "10.88.2.1", prefixLength: 32}}, host.Link("", "lo").addrs)
+	assert.Empty(t, hostRecord.Addresses)
+	assert.NoError(t, hostRecord.Teardown())
+	assert.Equal(t, []fakeAddr{{ip: "10.88.2.1", prefixLength: 32}}, host.Link("", "lo").addrs)
+}
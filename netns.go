@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+// getNetns returns a handle of the network namespace at the given path, or of
+// the current one if the path is empty. The handle must be closed.
+func getNetns(path string) (netns.NsHandle, error) {
+	if path == "" {
+		return netns.Get()
+	}
+	ns, err := netns.GetFromPath(path)
+	if err != nil {
+		return netns.None(), fmt.Errorf("cannot open network namespace %s: %v", path, err)
+	}
+	return ns, nil
+}
+
+// netlinkHandle returns a netlink handle in the network namespace at the given
+// path, or in the current one if the path is empty
+func netlinkHandle(path string) (*netlink.Handle, error) {
+	if path == "" {
+		return netlink.NewHandle()
+	}
+	ns, err := getNetns(path)
+	if err != nil {
+		return nil, err
+	}
+	defer ns.Close()
+	return netlink.NewHandleAt(ns)
+}
+
+// inNetns runs fn with a thread in the network namespace at the given path,
+// for the operations that act on the namespace of the thread, like sysctls and
+// executed commands. It runs fn directly if the path is empty.
+//
+// fn runs on a dedicated goroutine locked to its thread. The thread is only
+// released once restored to the original namespace, otherwise it exits with
+// the goroutine and is never reused.
+func inNetns(path string, fn func() error) error {
+	if path == "" {
+		return fn()
+	}
+	errc := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+		errc <- runInNetns(path, fn)
+	}()
+	return <-errc
+}
+
+// runInNetns runs fn in the namespace at the given path on the locked thread
+// and restores the thread namespace, unlocking the thread on success
+func runInNetns(path string, fn func() error) error {
+	current, err := netns.Get()
+	if err != nil {
+		return fmt.Errorf("cannot get current network namespace: %v", err)
+	}
+	defer current.Close()
+	ns, err := getNetns(path)
+	if err != nil {
+		runtime.UnlockOSThread()
+		return err
+	}
+	defer ns.Close()
+	if err := netns.Set(ns); err != nil {
+		// The thread may be left in either namespace
+		return fmt.Errorf("cannot enter network namespace %s: %v", path, err)
+	}
+	fnErr := fn()
+	if err := netns.Set(current); err != nil {
+		return errors.Join(fnErr, fmt.Errorf("cannot restore network namespace: %v", err))
+	}
+	runtime.UnlockOSThread()
+	return fnErr
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInNetns(t *testing.T) {
+	// The current namespace is used without a path
+	called := false
+	assert.NoError(t, inNetns("", func() error {
+		called = true
+		return nil
+	}))
+	assert.True(t, called)
+
+	errFn := errors.New("fn error")
+	assert.Equal(t, errFn, inNetns("", func() error { return errFn }))
+
+	// Missing namespaces are reported without running fn
+	called = false
+	assert.Error(t, inNetns("/var/run/netns/missing", func() error {
+		called = true
+		return nil
+	}))
+	assert.False(t, called)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/osrg/gobgp/v4/api"
+	"github.com/osrg/gobgp/v4/pkg/apiutil"
+	"github.com/osrg/gobgp/v4/pkg/packet/bgp"
+	"github.com/osrg/gobgp/v4/pkg/server"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testRouterASN      = 65000
+	testRouterID       = "10.0.0.254"
+	testLocalASN       = 65001
+	testLocalRouterID  = "10.0.0.1"
+	testRouterTimeout  = 15 * time.Second
+	testRouterInterval = 100 * time.Millisecond
+)
+
+// testRouter is a gobgp server on loopback that plays the router peering with
+// bgp-lb. The bgp-lb server listens on a free port and the router connects to
+// it, as both peers share the loopback address.
+type testRouter struct {
+	server *server.BgpServer
+}
+
+// receivedPath is a path received by the test router
+type receivedPath struct {
+	nextHop     string
+	communities []uint32
+}
+
+// newTestBgpServer starts a bgp-lb server peered with a new test router. Both
+// are stopped at the end of the test.
+func newTestBgpServer(t *testing.T) (*BgpServer, *testRouter) {
+	t.Helper()
+	port := freePort(t)
+	bs, err := initBgpServer(testLocalRouterID, testLocalASN, int32(port), "", nil, false)
+	require.NoError(t, err)
+	t.Cleanup(func() { bs.Stop() })
+	require.NoError(t, bs.AddPeer("127.0.0.1", testRouterASN))
+
+	s := server.NewBgpServer()
+	go s.Serve()
+	require.NoError(t, s.StartBgp(context.Background(), &api.StartBgpRequest{
+		Global: &api.Global{
+			Asn:        testRouterASN,
+			RouterId:   testRouterID,
+			ListenPort: -1,
+		},
+	}))
+	t.Cleanup(func() { s.StopBgp(context.Background(), &api.StopBgpRequest{}) })
+	require.NoError(t, s.AddPeer(context.Background(), &api.AddPeerRequest{Peer: &api.Peer{
+		Conf: &api.PeerConf{
+			NeighborAddress: "127.0.0.1",
+			PeerAsn:         testLocalASN,
+		},
+		Transport: &api.Transport{RemotePort: uint32(port)},
+		Timers: &api.Timers{Config: &api.TimersConfig{
+			ConnectRetry: 1,
+		}},
+	}}))
+	return bs, &testRouter{server: s}
+}
+
+// freePort returns a tcp port that is free on loopback
+func freePort(t *testing.T) int {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// WaitEstablished waits for the session with bgp-lb to be established
+func (r *testRouter) WaitEstablished(t *testing.T) {
+	t.Helper()
+	require.Eventually(t, func() bool {
+		established := false
+		r.server.ListPeer(context.Background(), &api.ListPeerRequest{}, func(p *api.Peer) {
+			established = p.State != nil && p.State.SessionState == api.PeerState_SESSION_STATE_ESTABLISHED
+		})
+		return established
+	}, testRouterTimeout, testRouterInterval, "bgp session not established")
+}
+
+// Paths returns the ipv4 paths received by the router, by prefix
+func (r *testRouter) Paths() (map[string]receivedPath, error) {
+	paths := map[string]receivedPath{}
+	err := r.server.ListPath(apiutil.ListPathRequest{
+		TableType: api.TableType_TABLE_TYPE_GLOBAL,
+		Family:    bgp.RF_IPv4_UC,
+	}, func(prefix bgp.NLRI, ps []*apiutil.Path) {
+		for _, p := range ps {
+			var rp receivedPath
+			for _, attr := range p.Attrs {
+				switch a := attr.(type) {
+				case *bgp.PathAttributeNextHop:
+					rp.nextHop = a.Value.String()
+				case *bgp.PathAttributeCommunities:
+					rp.communities = a.Value
+				}
+			}
+			paths[prefix.String()] = rp
+		}
+	})
+	return paths, err
+}
+
+// WaitPath waits for the router to receive a path for the prefix that
+// satisfies the condition. Failures to list the paths are retried.
+func (r *testRouter) WaitPath(t *testing.T, prefix string, cond func(receivedPath) bool) {
+	t.Helper()
+	require.Eventually(t, func() bool {
+		paths, err := r.Paths()
+		if err != nil {
+			return false
+		}
+		p, ok := paths[prefix]
+		return ok && cond(p)
+	}, testRouterTimeout, testRouterInterval, "path %s not received", prefix)
+}
+
+// WaitWithdrawn waits for the path of the prefix to be withdrawn. Failures to
+// list the paths are retried.
+func (r *testRouter) WaitWithdrawn(t *testing.T, prefix string) {
+	t.Helper()
+	require.Eventually(t, func() bool {
+		paths, err := r.Paths()
+		if err != nil {
+			return false
+		}
+		_, ok := paths[prefix]
+		return !ok
+	}, testRouterTimeout, testRouterInterval, "path %s not withdrawn", prefix)
+}
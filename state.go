@@ -0,0 +1,333 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"syscall"
+
+	libipvs "github.com/moby/ipvs"
+	log "github.com/sirupsen/logrus"
+)
+
+// hostRecord is the record of the host resources installed by bgp-lb. It is
+// nil when network setup is disabled.
+var hostRecord *hostState
+
+type deviceRecord struct {
+	Netns string `json:"netns"`
+	Name  string `json:"name"`
+}
+
+type addressRecord struct {
+	Netns        string `json:"netns"`
+	Device       string `json:"device"`
+	IP           string `json:"ip"`
+	PrefixLength int    `json:"prefixLength"`
+}
+
+type ipvsServiceRecord struct {
+	Netns    string `json:"netns"`
+	FWMark   uint32 `json:"fwmark,omitempty"`
+	Protocol string `json:"protocol,omitempty"`
+	Address  string `json:"address,omitempty"`
+	Port     uint16 `json:"port,omitempty"`
+}
+
+type fwmarkRuleRecord struct {
+	Netns string   `json:"netns"`
+	Chain string   `json:"chain"`
+	Rule  []string `json:"rule"`
+}
+
+// sysctlRecord holds the value of a sysctl before bgp-lb changed it
+type sysctlRecord struct {
+	Netns string `json:"netns"`
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+type syncDaemonRecord struct {
+	Netns string `json:"netns"`
+	State uint32 `json:"state"`
+}
+
+// hostState records the host resources installed by bgp-lb, persisted in a
+// state file so that they can be removed on shutdown or by the cleanup
+// command, even after a crash. Pre-existing resources that bgp-lb reuses, like
+// a shared device, are not recorded.
+type hostState struct {
+	path string
+	host HostNetwork
+	lb   LoadBalancer
+	mu   sync.Mutex
+
+	Devices      []deviceRecord      `json:"devices"`
+	Addresses    []addressRecord     `json:"addresses"`
+	IPVSServices []ipvsServiceRecord `json:"ipvsServices"`
+	FWMarkRules  []fwmarkRuleRecord  `json:"fwmarkRules"`
+	Sysctls      []sysctlRecord      `json:"sysctls"`
+	SyncDaemons  []syncDaemonRecord  `json:"syncDaemons"`
+}
+
+// loadHostState reads the state file, if it exists. The recorded resources are
+// removed from the given host network and load balancer.
+func loadHostState(path string, host HostNetwork, lb LoadBalancer) (*hostState, error) {
+	s := &hostState{path: path, host: host, lb: lb}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading state file: %v", err)
+	}
+	if err := json.Unmarshal(b, s); err != nil {
+		return nil, fmt.Errorf("error unmarshalling state file: %v", err)
+	}
+	return s, nil
+}
+
+// save writes the state file atomically, or deletes it when nothing is
+// recorded. It must be called with the lock held.
+func (s *hostState) save() {
+	if err := s.write(); err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+			"path":  s.path,
+		}).Warn("Cannot save the host state file")
+	}
+}
+
+func (s *hostState) write() error {
+	if s.empty() {
+		if err := os.Remove(s.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+func (s *hostState) empty() bool {
+	return len(s.Devices) == 0 && len(s.Addresses) == 0 && len(s.IPVSServices) == 0 &&
+		len(s.FWMarkRules) == 0 && len(s.Sysctls) == 0 && len(s.SyncDaemons) == 0
+}
+
+// RecordDevice records a device created by bgp-lb
+func (s *hostState) RecordDevice(netns, name string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r := deviceRecord{Netns: netns, Name: name}
+	if !slices.Contains(s.Devices, r) {
+		s.Devices = append(s.Devices, r)
+		s.save()
+	}
+}
+
+// RecordAddress records an address added by bgp-lb
+func (s *hostState) RecordAddress(netns, device, ip string, prefixLength int) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r := addressRecord{Netns: netns, Device: device, IP: ip, PrefixLength: prefixLength}
+	if !slices.Contains(s.Addresses, r) {
+		s.Addresses = append(s.Addresses, r)
+		s.save()
+	}
+}
+
+// ForgetAddress removes an address deleted by bgp-lb from the record
+func (s *hostState) ForgetAddress(netns, device, ip string, prefixLength int) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r := addressRecord{Netns: netns, Device: device, IP: ip, PrefixLength: prefixLength}
+	if i := slices.Index(s.Addresses, r); i >= 0 {
+		s.Addresses = slices.Delete(s.Addresses, i, i+1)
+		s.save()
+	}
+}
+
+// RecordIPVSServices records ipvs services created by bgp-lb
+func (s *hostState) RecordIPVSServices(netns string, svcs []*libipvs.Service) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	changed := false
+	for _, svc := range svcs {
+		r := toIPVSServiceRecord(netns, svc)
+		if !slices.Contains(s.IPVSServices, r) {
+			s.IPVSServices = append(s.IPVSServices, r)
+			changed = true
+		}
+	}
+	if changed {
+		s.save()
+	}
+}
+
+// ForgetIPVSServices removes ipvs services deleted by bgp-lb from the record
+func (s *hostState) ForgetIPVSServices(netns string, svcs []*libipvs.Service) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := len(s.IPVSServices)
+	for _, svc := range svcs {
+		r := toIPVSServiceRecord(netns, svc)
+		s.IPVSServices = slices.DeleteFunc(s.IPVSServices, func(o ipvsServiceRecord) bool { return o == r })
+	}
+	if len(s.IPVSServices) != n {
+		s.save()
+	}
+}
+
+// RecordFWMarkRule records an iptables rule added by bgp-lb
+func (s *hostState) RecordFWMarkRule(netns, chain string, rule []string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if slices.ContainsFunc(s.FWMarkRules, func(r fwmarkRuleRecord) bool {
+		return r.Netns == netns && r.Chain == chain && slices.Equal(r.Rule, rule)
+	}) {
+		return
+	}
+	s.FWMarkRules = append(s.FWMarkRules, fwmarkRuleRecord{Netns: netns, Chain: chain, Rule: rule})
+	s.save()
+}
+
+// RecordSysctls records the values of sysctls before bgp-lb changed them. The
+// first recorded value of a sysctl is kept, as later ones may have been set by
+// bgp-lb.
+func (s *hostState) RecordSysctls(netns string, previous sysctlValues) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	changed := false
+	for key, value := range previous {
+		if slices.ContainsFunc(s.Sysctls, func(r sysctlRecord) bool { return r.Netns == netns && r.Key == key }) {
+			continue
+		}
+		s.Sysctls = append(s.Sysctls, sysctlRecord{Netns: netns, Key: key, Value: value})
+		changed = true
+	}
+	if changed {
+		s.save()
+	}
+}
+
+// RecordSyncDaemons records ipvs sync daemons started by bgp-lb
+func (s *hostState) RecordSyncDaemons(netns string, daemons []ipvsSyncDaemon) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	changed := false
+	for _, d := range daemons {
+		r := syncDaemonRecord{Netns: netns, State: d.State}
+		if !slices.Contains(s.SyncDaemons, r) {
+			s.SyncDaemons = append(s.SyncDaemons, r)
+			changed = true
+		}
+	}
+	if changed {
+		s.save()
+	}
+}
+
+// Teardown removes the recorded resources from the host. Resources that
+// cannot be removed are kept in the record and their errors are returned.
+func (s *hostState) Teardown() error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var errs []error
+	s.IPVSServices = slices.DeleteFunc(s.IPVSServices, func(r ipvsServiceRecord) bool {
+		return teardownStep(&errs, "ipvs service", s.lb.DeleteService(r.Netns, r.service()))
+	})
+	s.FWMarkRules = slices.DeleteFunc(s.FWMarkRules, func(r fwmarkRuleRecord) bool {
+		return teardownStep(&errs, "fwmark rule", inNetns(r.Netns, func() error { return deleteFWMarkRule(r.Chain, r.Rule) }))
+	})
+	s.SyncDaemons = slices.DeleteFunc(s.SyncDaemons, func(r syncDaemonRecord) bool {
+		return teardownStep(&errs, "ipvs sync daemon", stopIPVSSyncDaemons(s.lb, r.Netns, []ipvsSyncDaemon{{State: r.State}}))
+	})
+	s.Addresses = slices.DeleteFunc(s.Addresses, func(r addressRecord) bool {
+		return teardownStep(&errs, "address", s.host.DeleteAddress(r.Netns, r.IP, r.Device, r.PrefixLength))
+	})
+	s.Devices = slices.DeleteFunc(s.Devices, func(r deviceRecord) bool {
+		return teardownStep(&errs, "device", s.host.DeleteDevice(r.Netns, r.Name))
+	})
+	s.Sysctls = slices.DeleteFunc(s.Sysctls, func(r sysctlRecord) bool {
+		return teardownStep(&errs, "sysctl", inNetns(r.Netns, func() error { return writeSysctl(r.Key, r.Value) }))
+	})
+	s.save()
+	return errors.Join(errs...)
+}
+
+// teardownStep collects the error of removing a resource and returns whether
+// it was removed
+func teardownStep(errs *[]error, resource string, err error) bool {
+	if err != nil {
+		*errs = append(*errs, fmt.Errorf("cannot remove %s: %v", resource, err))
+		return false
+	}
+	return true
+}
+
+func toIPVSServiceRecord(netns string, svc *libipvs.Service) ipvsServiceRecord {
+	if svc.FWMark != 0 {
+		return ipvsServiceRecord{Netns: netns, FWMark: svc.FWMark}
+	}
+	return ipvsServiceRecord{
+		Netns:    netns,
+		Protocol: protocolToString(svc.Protocol),
+		Address:  svc.Address.String(),
+		Port:     svc.Port,
+	}
+}
+
+// service returns the ipvs service matching the record
+func (r ipvsServiceRecord) service() *libipvs.Service {
+	if r.FWMark != 0 {
+		return &libipvs.Service{FWMark: r.FWMark, AddressFamily: syscall.AF_INET}
+	}
+	return &libipvs.Service{
+		Address:       net.ParseIP(r.Address),
+		Protocol:      stringToProtocol(r.Protocol),
+		Port:          r.Port,
+		AddressFamily: syscall.AF_INET,
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	libipvs "github.com/moby/ipvs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHostStateRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	s, err := loadHostState(path, nil, nil)
+	assert.NoError(t, err)
+
+	s.RecordDevice("", "bgplb0")
+	s.RecordAddress("", "bgplb0", "10.0.0.1", 32)
+	s.RecordIPVSServices("/run/netns/lb", []*libipvs.Service{
+		{Address: net.ParseIP("10.0.0.1"), Protocol: syscall.IPPROTO_TCP, Port: 80, AddressFamily: syscall.AF_INET},
+		{FWMark: 10, AddressFamily: syscall.AF_INET},
+	})
+	s.RecordFWMarkRule("", "PREROUTING", []string{"-d", "10.0.0.1/32", "-j", "MARK", "--set-mark", "10"})
+	s.RecordSysctls("", sysctlValues{"net/ipv4/conf/all/arp_ignore": "0"})
+	// The value before bgp-lb changed it is kept
+	s.RecordSysctls("", sysctlValues{"net/ipv4/conf/all/arp_ignore": "1"})
+	s.RecordSyncDaemons("/run/netns/lb", []ipvsSyncDaemon{{State: ipvsSyncStateMaster, Interface: "eth0"}})
+
+	loaded, err := loadHostState(path, nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []deviceRecord{{Name: "bgplb0"}}, loaded.Devices)
+	assert.Equal(t, []addressRecord{{Device: "bgplb0", IP: "10.0.0.1", PrefixLength: 32}}, loaded.Addresses)
+	assert.Equal(t, []ipvsServiceRecord{
+		{Netns: "/run/netns/lb", Protocol: "tcp", Address: "10.0.0.1", Port: 80},
+		{Netns: "/run/netns/lb", FWMark: 10},
+	}, loaded.IPVSServices)
+	assert.Len(t, loaded.FWMarkRules, 1)
+	assert.Equal(t, []sysctlRecord{{Key: "net/ipv4/conf/all/arp_ignore", Value: "0"}}, loaded.Sysctls)
+	assert.Equal(t, []syncDaemonRecord{{Netns: "/run/netns/lb", State: ipvsSyncStateMaster}}, loaded.SyncDaemons)
+
+	svc := loaded.IPVSServices[0].service()
+	assert.Equal(t, "tcp:10.0.0.1:80", ipvsServiceKey(svc))
+}
+
+func TestHostStateEmpty(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	s, err := loadHostState(path, nil, nil)
+	assert.NoError(t, err)
+
+	s.RecordAddress("", "eth0", "10.0.0.1", 32)
+	assert.FileExists(t, path)
+	s.ForgetAddress("", "eth0", "10.0.0.1", 32)
+	assert.NoFileExists(t, path)
+
+	// A nil record, when network setup is disabled, records nothing
+	var nilState *hostState
+	nilState.RecordAddress("", "eth0", "10.0.0.1", 32)
+	assert.NoError(t, nilState.Teardown())
+}
+
+func TestHostStateTeardownSysctls(t *testing.T) {
+	sysctlRoot = t.TempDir()
+	defer func() { sysctlRoot = "/proc/sys" }()
+	assert.NoError(t, os.MkdirAll(filepath.Join(sysctlRoot, "net/ipv4/conf/all"), 0755))
+	assert.NoError(t, os.WriteFile(sysctlPath("net/ipv4/conf/all/arp_ignore"), []byte("1\n"), 0644))
+
+	path := filepath.Join(t.TempDir(), "state.json")
+	s, err := loadHostState(path, nil, nil)
+	assert.NoError(t, err)
+	s.RecordSysctls("", sysctlValues{"net/ipv4/conf/all/arp_ignore": "0"})
+
+	assert.NoError(t, s.Teardown())
+	value, err := readSysctl("net/ipv4/conf/all/arp_ignore")
+	assert.NoError(t, err)
+	assert.Equal(t, "0", value)
+	assert.Empty(t, s.Sysctls)
+	assert.NoFileExists(t, path)
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+// IPVS generic netlink commands and attributes, see include/uapi/linux/ip_vs.h
+const (
+	ipvsGenlName    = "IPVS"
+	ipvsGenlVersion = 1
+
+	ipvsCmdNewDaemon = 9
+	ipvsCmdDelDaemon = 10
+	ipvsCmdGetDaemon = 11
+
+	ipvsCmdAttrDaemon = 3
+
+	ipvsDaemonAttrState    = 1
+	ipvsDaemonAttrMcastIfn = 2
+	ipvsDaemonAttrSyncID   = 3
+
+	ipvsSyncStateMaster = 1
+	ipvsSyncStateBackup = 2
+)
+
+var (
+	// ipvsSyncStates maps the sync daemon states to the kernel values
+	ipvsSyncStates = map[string]uint32{
+		"master": ipvsSyncStateMaster,
+		"backup": ipvsSyncStateBackup,
+	}
+)
+
+// ipvsSyncDaemon is an ipvs connection sync daemon, either sending (master) or
+// receiving (backup) connection state over multicast on an interface
+type ipvsSyncDaemon struct {
+	State     uint32
+	Interface string
+	SyncID    uint32
+}
+
+func (d ipvsSyncDaemon) String() string {
+	for name, state := range ipvsSyncStates {
+		if state == d.State {
+			return name
+		}
+	}
+	return fmt.Sprint(d.State)
+}
+
+// validateIPVSSyncConfig checks the sync daemon states and interface
+func validateIPVSSyncConfig(c *ipvsSyncConfig) error {
+	if len(c.States) == 0 {
+		return fmt.Errorf("no ipvs sync daemon states")
+	}
+	for _, state := range c.States {
+		if _, ok := ipvsSyncStates[state]; !ok {
+			return fmt.Errorf("unknown ipvs sync daemon state: %s", state)
+		}
+	}
+	if c.Interface == "" {
+		return fmt.Errorf("missing ipvs sync daemon interface")
+	}
+	return nil
+}
+
+// toIPVSSyncDaemons returns the sync daemons described by the config
+func toIPVSSyncDaemons(c *ipvsSyncConfig) []ipvsSyncDaemon {
+	var daemons []ipvsSyncDaemon
+	for _, state := range c.States {
+		daemons = append(daemons, ipvsSyncDaemon{
+			State:     ipvsSyncStates[state],
+			Interface: c.Interface,
+			SyncID:    uint32(c.SyncID),
+		})
+	}
+	return daemons
+}
+
+// ensureIPVSSyncDaemons starts the desired sync daemons that are not running
+// in the namespace and restarts the ones running with different options
+func ensureIPVSSyncDaemons(lb LoadBalancer, netns string, desired []ipvsSyncDaemon) error {
+	running, err := lb.SyncDaemons(netns)
+	if err != nil {
+		return err
+	}
+	for _, d := range desired {
+		i := slices.IndexFunc(running, func(r ipvsSyncDaemon) bool { return r.State == d.State })
+		if i >= 0 && running[i] == d {
+			continue
+		}
+		if i >= 0 {
+			if err := lb.DeleteSyncDaemon(netns, d.State); err != nil {
+				return fmt.Errorf("Cannot stop ipvs %s sync daemon: %v", d, err)
+			}
+		}
+		if err := lb.AddSyncDaemon(netns, d); err != nil {
+			return fmt.Errorf("Cannot start ipvs %s sync daemon: %v", d, err)
+		}
+		hostRecord.RecordSyncDaemons(netns, []ipvsSyncDaemon{d})
+		log.WithFields(log.Fields{
+			"state":     d.String(),
+			"interface": d.Interface,
+			"sync_id":   d.SyncID,
+		}).Info("Started ipvs sync daemon")
+	}
+	return nil
+}
+
+// watchIPVSSyncDaemons periodically restarts the sync daemons that have been
+// stopped or changed by other tools
+func watchIPVSSyncDaemons(lb LoadBalancer, netns string, desired []ipvsSyncDaemon, interval time.Duration) {
+	for t := time.Tick(interval); ; <-t {
+		if err := ensureIPVSSyncDaemons(lb, netns, desired); err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+			}).Warn("Cannot ensure ipvs sync daemons")
+		}
+	}
+}
+
+// stopIPVSSyncDaemons stops the given sync daemons of the namespace, if
+// running
+func stopIPVSSyncDaemons(lb LoadBalancer, netns string, daemons []ipvsSyncDaemon) error {
+	running, err := lb.SyncDaemons(netns)
+	if err != nil {
+		return err
+	}
+	for _, d := range daemons {
+		if !slices.ContainsFunc(running, func(r ipvsSyncDaemon) bool { return r.State == d.State }) {
+			continue
+		}
+		if err := lb.DeleteSyncDaemon(netns, d.State); err != nil {
+			return fmt.Errorf("Cannot stop ipvs %s sync daemon: %v", d, err)
+		}
+	}
+	return nil
+}
+
+// ipvsRequest returns an ipvs generic netlink request for the given command
+func ipvsRequest(cmd uint8, flags int) (*nl.NetlinkRequest, error) {
+	family, err := netlink.GenlFamilyGet(ipvsGenlName)
+	if err != nil {
+		return nil, fmt.Errorf("IPVS generic netlink family not found: %v", err)
+	}
+	req := nl.NewNetlinkRequest(int(family.ID), flags)
+	req.AddData(&nl.Genlmsg{Command: cmd, Version: ipvsGenlVersion})
+	return req, nil
+}
+
+// Sync daemons are not reachable via libipvs handles, so the generic netlink
+// requests are sent from a thread in the namespace instead
+
+func (ipvsLoadBalancer) AddSyncDaemon(netns string, d ipvsSyncDaemon) error {
+	return inNetns(netns, func() error {
+		req, err := ipvsRequest(ipvsCmdNewDaemon, unix.NLM_F_ACK)
+		if err != nil {
+			return err
+		}
+		req.AddData(ipvsSyncDaemonAttr(d))
+		_, err = req.Execute(unix.NETLINK_GENERIC, 0)
+		return err
+	})
+}
+
+func (ipvsLoadBalancer) DeleteSyncDaemon(netns string, state uint32) error {
+	return inNetns(netns, func() error {
+		req, err := ipvsRequest(ipvsCmdDelDaemon, unix.NLM_F_ACK)
+		if err != nil {
+			return err
+		}
+		attr := nl.NewRtAttr(ipvsCmdAttrDaemon, nil)
+		attr.AddRtAttr(ipvsDaemonAttrState, nl.Uint32Attr(state))
+		req.AddData(attr)
+		_, err = req.Execute(unix.NETLINK_GENERIC, 0)
+		return err
+	})
+}
+
+func (ipvsLoadBalancer) SyncDaemons(netns string) ([]ipvsSyncDaemon, error) {
+	var msgs [][]byte
+	err := inNetns(netns, func() error {
+		req, err := ipvsRequest(ipvsCmdGetDaemon, unix.NLM_F_DUMP)
+		if err != nil {
+			return err
+		}
+		msgs, err = req.Execute(unix.NETLINK_GENERIC, 0)
+		if err != nil {
+			return fmt.Errorf("Cannot retrieve ipvs sync daemons: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	var daemons []ipvsSyncDaemon
+	for _, msg := range msgs {
+		if len(msg) < nl.SizeofGenlmsg {
+			continue
+		}
+		attrs, err := nl.ParseRouteAttr(msg[nl.SizeofGenlmsg:])
+		if err != nil {
+			return nil, err
+		}
+		for _, attr := range attrs {
+			if attr.Attr.Type&nl.NLA_TYPE_MASK != ipvsCmdAttrDaemon {
+				continue
+			}
+			d, err := parseIPVSSyncDaemon(attr.Value)
+			if err != nil {
+				return nil, err
+			}
+			daemons = append(daemons, d)
+		}
+	}
+	return daemons, nil
+}
+
+// ipvsSyncDaemonAttr returns the nested netlink attribute of a sync daemon
+func ipvsSyncDaemonAttr(d ipvsSyncDaemon) *nl.RtAttr {
+	attr := nl.NewRtAttr(ipvsCmdAttrDaemon, nil)
+	attr.AddRtAttr(ipvsDaemonAttrState, nl.Uint32Attr(d.State))
+	attr.AddRtAttr(ipvsDaemonAttrMcastIfn, nl.ZeroTerminated(d.Interface))
+	attr.AddRtAttr(ipvsDaemonAttrSyncID, nl.Uint32Attr(d.SyncID))
+	return attr
+}
+
+// parseIPVSSyncDaemon parses the attributes nested in a daemon attribute
+func parseIPVSSyncDaemon(b []byte) (ipvsSyncDaemon, error) {
+	var d ipvsSyncDaemon
+	attrs, err := nl.ParseRouteAttr(b)
+	if err != nil {
+		return d, err
+	}
+	for _, attr := range attrs {
+		switch attr.Attr.Type & nl.NLA_TYPE_MASK {
+		case ipvsDaemonAttrState:
+			d.State = nl.NativeEndian().Uint32(attr.Value)
+		case ipvsDaemonAttrMcastIfn:
+			d.Interface = strings.TrimRight(string(attr.Value), "\x00")
+		case ipvsDaemonAttrSyncID:
+			d.SyncID = nl.NativeEndian().Uint32(attr.Value)
+		}
+	}
+	return d, nil
+}
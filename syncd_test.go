@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIPVSSyncDaemonAttr(t *testing.T) {
+	d := ipvsSyncDaemon{State: ipvsSyncStateBackup, Interface: "eth0", SyncID: 7}
+	attr := ipvsSyncDaemonAttr(d).Serialize()
+	// Skip the daemon attribute header to parse the nested attributes
+	parsed, err := parseIPVSSyncDaemon(attr[4:])
+	assert.NoError(t, err)
+	assert.Equal(t, d, parsed)
+	assert.Equal(t, "backup", parsed.String())
+}
+
+func TestToIPVSSyncDaemons(t *testing.T) {
+	c := &ipvsSyncConfig{States: []string{"master", "backup"}, Interface: "eth0", SyncID: 7}
+	assert.NoError(t, validateIPVSSyncConfig(c))
+	assert.Equal(t, []ipvsSyncDaemon{
+		{State: ipvsSyncStateMaster, Interface: "eth0", SyncID: 7},
+		{State: ipvsSyncStateBackup, Interface: "eth0", SyncID: 7},
+	}, toIPVSSyncDaemons(c))
+
+	assert.Error(t, validateIPVSSyncConfig(&ipvsSyncConfig{Interface: "eth0"}))
+	assert.Error(t, validateIPVSSyncConfig(&ipvsSyncConfig{States: []string{"slave"}, Interface: "eth0"}))
+	assert.Error(t, validateIPVSSyncConfig(&ipvsSyncConfig{States: []string{"master"}}))
+}
+
+func TestEnsureIPVSSyncDaemons(t *testing.T) {
+	lb := newFakeLoadBalancer()
+	useHostRecord(t, newFakeHostNetwork(), lb)
+	// A daemon running with other options is restarted
+	assert.NoError(t, lb.AddSyncDaemon("/run/netns/lb", ipvsSyncDaemon{State: ipvsSyncStateMaster, Interface: "eth1"}))
+	desired := toIPVSSyncDaemons(&ipvsSyncConfig{States: []string{"master", "backup"}, Interface: "eth0", SyncID: 7})
+	assert.NoError(t, ensureIPVSSyncDaemons(lb, "/run/netns/lb", desired))
+	running, err := lb.SyncDaemons("/run/netns/lb")
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, desired, running)
+	// The daemons run in the namespace of the ipvs services only
+	running, err = lb.SyncDaemons("")
+	assert.NoError(t, err)
+	assert.Empty(t, running)
+
+	assert.NoError(t, hostRecord.Teardown())
+	running, err = lb.SyncDaemons("/run/netns/lb")
+	assert.NoError(t, err)
+	assert.Empty(t, running)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultArpIgnore   = 1 // reply only for addresses of the incoming interface
+	defaultArpAnnounce = 2 // use the best local address for the target
+	defaultNdiscNotify = 0 // do not advertise addresses on device changes
+)
+
+var (
+	// sysctlRoot is where the kernel parameters are exposed
+	sysctlRoot = "/proc/sys"
+)
+
+// sysctlValues holds kernel parameter values by path under the sysctl root,
+// e.g. net/ipv4/conf/all/arp_ignore. Paths are used instead of the dotted keys
+// as interface names can contain dots.
+type sysctlValues map[string]string
+
+// arpSuppressionSysctls returns the arp and ndp sysctls to set for the
+// service. Linux only answers neighbour solicitations for the addresses of the
+// incoming interface, so ipv6 needs no counterpart of arp_ignore, but it may
+// still send unsolicited neighbour advertisements, as set by ndisc_notify.
+func arpSuppressionSysctls(c *arpSuppressionConfig) (sysctlValues, error) {
+	arpIgnore, arpAnnounce, ndiscNotify := defaultArpIgnore, defaultArpAnnounce, defaultNdiscNotify
+	if c.ArpIgnore != nil {
+		arpIgnore = *c.ArpIgnore
+	}
+	if c.ArpAnnounce != nil {
+		arpAnnounce = *c.ArpAnnounce
+	}
+	if c.NdiscNotify != nil {
+		ndiscNotify = *c.NdiscNotify
+	}
+	if (arpIgnore < 0 || arpIgnore > 3) && arpIgnore != 8 {
+		return nil, fmt.Errorf("invalid arp_ignore: %d", arpIgnore)
+	}
+	if arpAnnounce < 0 || arpAnnounce > 2 {
+		return nil, fmt.Errorf("invalid arp_announce: %d", arpAnnounce)
+	}
+	if ndiscNotify < 0 || ndiscNotify > 1 {
+		return nil, fmt.Errorf("invalid ndisc_notify: %d", ndiscNotify)
+	}
+	interfaces := c.Interfaces
+	if len(interfaces) == 0 {
+		interfaces = []string{"all"}
+	}
+	values := sysctlValues{}
+	for _, iface := range interfaces {
+		values[fmt.Sprintf("net/ipv4/conf/%s/arp_ignore", iface)] = fmt.Sprint(arpIgnore)
+		values[fmt.Sprintf("net/ipv4/conf/%s/arp_announce", iface)] = fmt.Sprint(arpAnnounce)
+		values[fmt.Sprintf("net/ipv6/conf/%s/ndisc_notify", iface)] = fmt.Sprint(ndiscNotify)
+	}
+	return values, nil
+}
+
+// withoutDisabledIPv6 drops the ipv6 sysctls when ipv6 is disabled in the
+// current network namespace, as they do not exist then
+func (values sysctlValues) withoutDisabledIPv6() sysctlValues {
+	if _, err := os.Stat(sysctlPath("net/ipv6")); err == nil {
+		return values
+	}
+	filtered := sysctlValues{}
+	for key, value := range values {
+		if !strings.HasPrefix(key, "net/ipv6/") {
+			filtered[key] = value
+		}
+	}
+	return filtered
+}
+
+// applySysctls sets the given kernel parameters and returns their previous
+// values. It fails if a parameter does not hold the value after setting it.
+func applySysctls(values sysctlValues) (sysctlValues, error) {
+	previous := sysctlValues{}
+	for key, value := range values {
+		old, err := readSysctl(key)
+		if err != nil {
+			return previous, err
+		}
+		if old == value {
+			continue
+		}
+		if err := writeSysctl(key, value); err != nil {
+			return previous, err
+		}
+		previous[key] = old
+		if current, err := readSysctl(key); err != nil || current != value {
+			return previous, fmt.Errorf("sysctl %s is %q after setting it to %q: %v", key, current, value, err)
+		}
+		log.WithFields(log.Fields{
+			"sysctl":   key,
+			"value":    value,
+			"previous": old,
+		}).Info("Set sysctl")
+	}
+	return previous, nil
+}
+
+// Restore sets the kernel parameters back to the held values
+func (values sysctlValues) Restore() error {
+	for key, value := range values {
+		if err := writeSysctl(key, value); err != nil {
+			return err
+		}
+		log.WithFields(log.Fields{
+			"sysctl": key,
+			"value":  value,
+		}).Info("Restored sysctl")
+	}
+	return nil
+}
+
+func sysctlPath(key string) string {
+	return filepath.Join(sysctlRoot, key)
+}
+
+func readSysctl(key string) (string, error) {
+	b, err := os.ReadFile(sysctlPath(key))
+	if err != nil {
+		return "", fmt.Errorf("cannot read sysctl %s: %v", key, err)
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+func writeSysctl(key, value string) error {
+	if err := os.WriteFile(sysctlPath(key), []byte(value), 0644); err != nil {
+		return fmt.Errorf("cannot write sysctl %s: %v", key, err)
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestArpSuppressionSysctls(t *testing.T) {
+	values, err := arpSuppressionSysctls(&arpSuppressionConfig{})
+	assert.NoError(t, err)
+	assert.Equal(t, sysctlValues{
+		"net/ipv4/conf/all/arp_ignore":   "1",
+		"net/ipv4/conf/all/arp_announce": "2",
+		"net/ipv6/conf/all/ndisc_notify": "0",
+	}, values)
+
+	arpIgnore := 8
+	values, err = arpSuppressionSysctls(&arpSuppressionConfig{Interfaces: []string{"eth0.100"}, ArpIgnore: &arpIgnore})
+	assert.NoError(t, err)
+	assert.Equal(t, "8", values["net/ipv4/conf/eth0.100/arp_ignore"])
+	assert.Equal(t, "0", values["net/ipv6/conf/eth0.100/ndisc_notify"])
+
+	// Zero values are applied rather than defaulted
+	zero := 0
+	values, err = arpSuppressionSysctls(&arpSuppressionConfig{ArpIgnore: &zero, ArpAnnounce: &zero})
+	assert.NoError(t, err)
+	assert.Equal(t, "0", values["net/ipv4/conf/all/arp_ignore"])
+	assert.Equal(t, "0", values["net/ipv4/conf/all/arp_announce"])
+
+	invalid := 3
+	_, err = arpSuppressionSysctls(&arpSuppressionConfig{ArpAnnounce: &invalid})
+	assert.Error(t, err)
+	_, err = arpSuppressionSysctls(&arpSuppressionConfig{NdiscNotify: &invalid})
+	assert.Error(t, err)
+}
+
+func TestSysctlsWithoutDisabledIPv6(t *testing.T) {
+	sysctlRoot = t.TempDir()
+	defer func() { sysctlRoot = "/proc/sys" }()
+	values := sysctlValues{
+		"net/ipv4/conf/all/arp_ignore":   "1",
+		"net/ipv6/conf/all/ndisc_notify": "0",
+	}
+	assert.Equal(t, sysctlValues{"net/ipv4/conf/all/arp_ignore": "1"}, values.withoutDisabledIPv6())
+
+	assert.NoError(t, os.MkdirAll(filepath.Join(sysctlRoot, "net/ipv6"), 0755))
+	assert.Equal(t, values, values.withoutDisabledIPv6())
+}
+
+func TestApplySysctls(t *testing.T) {
+	sysctlRoot = t.TempDir()
+	defer func() { sysctlRoot = "/proc/sys" }()
+	assert.NoError(t, os.MkdirAll(filepath.Join(sysctlRoot, "net/ipv4/conf/all"), 0755))
+	assert.NoError(t, os.WriteFile(sysctlPath("net/ipv4/conf/all/arp_ignore"), []byte("0\n"), 0644))
+	assert.NoError(t, os.WriteFile(sysctlPath("net/ipv4/conf/all/arp_announce"), []byte("2\n"), 0644))
+
+	previous, err := applySysctls(sysctlValues{
+		"net/ipv4/conf/all/arp_ignore":   "1",
+		"net/ipv4/conf/all/arp_announce": "2",
+	})
+	assert.NoError(t, err)
+	// Unchanged values are not restored
+	assert.Equal(t, sysctlValues{"net/ipv4/conf/all/arp_ignore": "0"}, previous)
+	value, _ := readSysctl("net/ipv4/conf/all/arp_ignore")
+	assert.Equal(t, "1", value)
+
+	assert.NoError(t, previous.Restore())
+	value, _ = readSysctl("net/ipv4/conf/all/arp_ignore")
+	assert.Equal(t, "0", value)
+
+	// Missing interfaces are reported
+	_, err = applySysctls(sysctlValues{"net/ipv4/conf/eth9/arp_ignore": "1"})
+	assert.Error(t, err)
+}
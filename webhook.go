@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultWebhookBatchSize       = 10
+	defaultWebhookBatchIntervalMs = 1000
+	defaultWebhookMaxRetries      = 5
+	defaultWebhookTimeoutSeconds  = 5
+	minWebhookRetryInterval       = time.Second
+	maxWebhookRetryInterval       = time.Minute
+	// webhookQueueSize is the number of events queued for a webhook, while
+	// it is retrying, before new ones are dropped
+	webhookQueueSize = 1000
+	// webhookSignatureHeader holds the hex HMAC-SHA256 of the request body
+	webhookSignatureHeader = "X-Bgp-Lb-Signature"
+	// maxEventOutputLength limits the healthcheck output sent in an event
+	maxEventOutputLength = 512
+)
+
+// Types of the events sent to the webhooks
+const (
+	eventAdvertise   = "advertise"
+	eventWithdraw    = "withdraw"
+	eventPeerUp      = "peer_up"
+	eventPeerDown    = "peer_down"
+	eventCheckFailed = "check_failed"
+)
+
+var eventTypes = []string{
+	eventAdvertise,
+	eventWithdraw,
+	eventPeerUp,
+	eventPeerDown,
+	eventCheckFailed,
+}
+
+// event is a change of the service state sent to the webhooks. The service,
+// vip, node and time are set by the notifier.
+type event struct {
+	Type    string    `json:"type"`
+	Time    time.Time `json:"time"`
+	Service string    `json:"service"`
+	VIP     string    `json:"vip"`
+	Node    string    `json:"node"`
+	Reason  string    `json:"reason,omitempty"`
+	Peer    string    `json:"peer,omitempty"`
+	Check   string    `json:"check,omitempty"`
+	Error   string    `json:"error,omitempty"`
+	Output  string    `json:"output,omitempty"`
+}
+
+// webhookPayload is the body of a webhook request
+type webhookPayload struct {
+	Events []event `json:"events"`
+}
+
+// notifications sends the service events to the configured webhooks. It is
+// nil without webhooks, in which case events are discarded.
+var notifications *notifier
+
+// notifier sends the events of a service to the webhook sinks
+type notifier struct {
+	service string
+	vip     string
+	node    string
+	clock   clock
+	sinks   []*webhookSink
+	// ctx is cancelled on stop, which interrupts the deliveries in progress
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// newNotifier returns a notifier for the service events of the config, or nil
+// without webhooks
+func newNotifier(config *config, clock clock) (*notifier, error) {
+	if len(config.Webhooks) == 0 {
+		return nil, nil
+	}
+	n := &notifier{
+		service: config.Service.Name,
+		vip:     config.Service.IP,
+		node:    config.Bgp.Local.RouterId,
+		clock:   clock,
+	}
+	n.ctx, n.cancel = context.WithCancel(context.Background())
+	for _, wc := range config.Webhooks {
+		sink, err := newWebhookSink(wc, clock)
+		if err != nil {
+			return nil, err
+		}
+		n.sinks = append(n.sinks, sink)
+	}
+	return n, nil
+}
+
+// Start starts delivering the events to the webhooks
+func (n *notifier) Start() {
+	if n == nil {
+		return
+	}
+	for _, s := range n.sinks {
+		go s.Run(n.ctx)
+	}
+}
+
+// Stop cancels the deliveries in progress, sends the pending events once,
+// without retrying, and stops the webhooks
+func (n *notifier) Stop() {
+	if n == nil {
+		return
+	}
+	n.cancel()
+	for _, s := range n.sinks {
+		<-s.done
+	}
+}
+
+// Notify queues the event for the webhooks that accept its type
+func (n *notifier) Notify(e event) {
+	if n == nil {
+		return
+	}
+	e.Service, e.VIP, e.Node = n.service, n.vip, n.node
+	if e.Time.IsZero() {
+		e.Time = n.clock.Now()
+	}
+	if len(e.Output) > maxEventOutputLength {
+		e.Output = e.Output[:maxEventOutputLength]
+	}
+	for _, s := range n.sinks {
+		s.Enqueue(e)
+	}
+}
+
+// webhookSink delivers batches of events to a webhook
+type webhookSink struct {
+	name          string
+	url           string
+	secret        []byte
+	events        []string
+	batchSize     int
+	batchInterval time.Duration
+	maxRetries    int
+	client        *http.Client
+	clock         clock
+	queue         chan event
+	done          chan struct{}
+}
+
+func newWebhookSink(c webhookConfig, clock clock) (*webhookSink, error) {
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid webhook url: %v", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported webhook url scheme: %s", u.Scheme)
+	}
+	for _, e := range c.Events {
+		if !slices.Contains(eventTypes, e) {
+			return nil, fmt.Errorf("unknown webhook event: %s", e)
+		}
+	}
+	if c.BatchSize < 0 || c.BatchIntervalMs < 0 || (c.MaxRetries != nil && *c.MaxRetries < 0) || c.TimeoutSeconds < 0 {
+		return nil, fmt.Errorf("negative webhook batch size, interval, retries or timeout")
+	}
+	s := &webhookSink{
+		name:          c.Name,
+		url:           c.URL,
+		secret:        []byte(c.Secret),
+		events:        c.Events,
+		batchSize:     c.BatchSize,
+		batchInterval: time.Duration(c.BatchIntervalMs) * time.Millisecond,
+		maxRetries:    defaultWebhookMaxRetries,
+		client:        &http.Client{Timeout: time.Duration(c.TimeoutSeconds) * time.Second},
+		clock:         clock,
+		queue:         make(chan event, webhookQueueSize),
+		done:          make(chan struct{}),
+	}
+	// The url may contain a token, so it is never logged
+	if s.name == "" {
+		s.name = u.Host
+	}
+	if s.batchSize == 0 {
+		s.batchSize = defaultWebhookBatchSize
+	}
+	if s.batchInterval == 0 {
+		s.batchInterval = defaultWebhookBatchIntervalMs * time.Millisecond
+	}
+	if c.MaxRetries != nil {
+		s.maxRetries = *c.MaxRetries
+	}
+	if s.client.Timeout == 0 {
+		s.client.Timeout = defaultWebhookTimeoutSeconds * time.Second
+	}
+	return s, nil
+}
+
+// Enqueue queues the event if the webhook accepts its type. Events are
+// dropped while the queue is full, so that a failing webhook never blocks the
+// service.
+func (s *webhookSink) Enqueue(e event) {
+	if len(s.events) > 0 && !slices.Contains(s.events, e.Type) {
+		return
+	}
+	select {
+	case s.queue <- e:
+		repeatedLogs.Reset("webhook_queue:" + s.name)
+	default:
+		addWebhookEventsMetric(s.name, "dropped", 1)
+		repeatedLogs.Warn("webhook_queue:"+s.name, log.WithFields(log.Fields{
+			"webhook": s.name,
+			"event":   e.Type,
+		}), "Webhook queue is full, dropping event")
+	}
+}
+
+// Run delivers the queued events in batches, once a batch is full or the
+// batch interval passed since its first event, until the context is cancelled
+func (s *webhookSink) Run(ctx context.Context) {
+	defer close(s.done)
+	var batch []event
+	var flush <-chan time.Time
+	for {
+		select {
+		case e := <-s.queue:
+			batch = append(batch, e)
+			if len(batch) < s.batchSize {
+				if flush == nil {
+					flush = s.clock.After(s.batchInterval)
+				}
+				continue
+			}
+		case <-flush:
+		case <-ctx.Done():
+			s.drain(batch)
+			return
+		}
+		if !s.deliver(ctx, batch, s.maxRetries) {
+			s.drain(batch)
+			return
+		}
+		batch, flush = nil, nil
+	}
+}
+
+// drain sends the batch and the queued events once, without retrying, within
+// the request timeout
+func (s *webhookSink) drain(batch []event) {
+	for len(s.queue) > 0 {
+		batch = append(batch, <-s.queue)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s.client.Timeout)
+	defer cancel()
+	for len(batch) > 0 {
+		n := min(len(batch), s.batchSize)
+		if !s.deliver(ctx, batch[:n], 0) {
+			addWebhookEventsMetric(s.name, "failed", len(batch))
+			log.WithFields(log.Fields{
+				"webhook": s.name,
+				"events":  len(batch),
+			}).Error("Timed out delivering events to webhook on shutdown")
+			return
+		}
+		batch = batch[n:]
+	}
+}
+
+// deliver sends the batch, retrying up to the given times with an exponential
+// backoff, and records the result. It returns false, without recording the
+// result, if the context is cancelled before the batch is delivered.
+func (s *webhookSink) deliver(ctx context.Context, batch []event, retries int) bool {
+	err := s.send(ctx, batch, retries)
+	if err != nil && ctx.Err() != nil {
+		return false
+	}
+	if err != nil {
+		addWebhookEventsMetric(s.name, "failed", len(batch))
+		log.WithFields(log.Fields{
+			"webhook": s.name,
+			"events":  len(batch),
+			"error":   err,
+		}).Error("Cannot deliver events to webhook")
+		return true
+	}
+	addWebhookEventsMetric(s.name, "delivered", len(batch))
+	return true
+}
+
+// send posts the batch, retrying failed requests that may succeed later,
+// until the context is cancelled
+func (s *webhookSink) send(ctx context.Context, batch []event, retries int) error {
+	body, err := json.Marshal(webhookPayload{Events: batch})
+	if err != nil {
+		return fmt.Errorf("cannot encode events: %v", err)
+	}
+	for attempt := 0; ; attempt++ {
+		retry, err := s.post(ctx, body)
+		if err == nil {
+			return nil
+		}
+		if !retry || attempt >= retries {
+			return err
+		}
+		wait := min(minWebhookRetryInterval<<attempt, maxWebhookRetryInterval)
+		log.WithFields(log.Fields{
+			"webhook":  s.name,
+			"error":    err,
+			"retries":  attempt + 1,
+			"retry_in": wait,
+		}).Warn("Cannot deliver events to webhook, retrying")
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-s.clock.After(wait):
+		}
+	}
+}
+
+// post sends the body to the webhook. It returns whether a failed request
+// should be retried, on connection errors, 429 and 5xx responses.
+func (s *webhookSink) post(ctx context.Context, body []byte) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "bgp-lb/"+version)
+	if len(s.secret) > 0 {
+		req.Header.Set(webhookSignatureHeader, "sha256="+signWebhookBody(s.secret, body))
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		// The error includes the url
+		return true, fmt.Errorf("request failed: %v", errorWithoutURL(err))
+	}
+	defer func() {
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+	if resp.StatusCode >= http.StatusOK && resp.StatusCode < http.StatusMultipleChoices {
+		return false, nil
+	}
+	retry := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= http.StatusInternalServerError
+	return retry, fmt.Errorf("unexpected response status: %s", resp.Status)
+}
+
+// signWebhookBody returns the hex HMAC-SHA256 of the body
+func signWebhookBody(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// errorWithoutURL strips the request url from an http client error
+func errorWithoutURL(err error) error {
+	if uerr, ok := err.(*url.Error); ok {
+		return uerr.Err
+	}
+	return err
+}
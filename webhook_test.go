@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// webhookRequest is a request received by the test webhook server
+type webhookRequest struct {
+	signature string
+	body      []byte
+	events    []event
+}
+
+// testWebhookServer is a local webhook that records the requests and answers
+// with the queued status codes, then 200
+type testWebhookServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	statuses []int
+	requests chan webhookRequest
+}
+
+func newTestWebhookServer(t *testing.T, statuses ...int) *testWebhookServer {
+	t.Helper()
+	s := &testWebhookServer{statuses: statuses, requests: make(chan webhookRequest, 100)}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		var payload webhookPayload
+		require.NoError(t, json.Unmarshal(body, &payload))
+		s.requests <- webhookRequest{
+			signature: r.Header.Get(webhookSignatureHeader),
+			body:      body,
+			events:    payload.Events,
+		}
+		s.mu.Lock()
+		status := http.StatusOK
+		if len(s.statuses) > 0 {
+			status, s.statuses = s.statuses[0], s.statuses[1:]
+		}
+		s.mu.Unlock()
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// Request waits for the next request
+func (s *testWebhookServer) Request(t *testing.T) webhookRequest {
+	t.Helper()
+	select {
+	case r := <-s.requests:
+		return r
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook request not received")
+	}
+	return webhookRequest{}
+}
+
+// NoRequest checks that no request is received for a while
+func (s *testWebhookServer) NoRequest(t *testing.T) {
+	t.Helper()
+	select {
+	case r := <-s.requests:
+		t.Fatalf("unexpected webhook request: %s", r.body)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func eventTypesOf(events []event) []string {
+	var types []string
+	for _, e := range events {
+		types = append(types, e.Type)
+	}
+	return types
+}
+
+func testWebhookConfig(webhooks ...webhookConfig) *config {
+	return &config{
+		Bgp:      bgpConfig{Local: localConfig{RouterId: "10.0.0.1"}},
+		Service:  serviceConfig{Name: "ingress", IP: "10.88.2.1"},
+		Webhooks: webhooks,
+	}
+}
+
+func TestNewNotifier(t *testing.T) {
+	negative, zero := -1, 0
+	n, err := newNotifier(testWebhookConfig(), realClock{})
+	require.NoError(t, err)
+	assert.Nil(t, n)
+	// A nil notifier discards the events
+	n.Notify(event{Type: eventAdvertise})
+
+	for _, wc := range []webhookConfig{
+		{URL: "ftp://example.com/hook"},
+		{URL: "http://example.com/hook", Events: []string{"reboot"}},
+		{URL: "http://example.com/hook", BatchSize: -1},
+		{URL: "http://example.com/hook", MaxRetries: &negative},
+	} {
+		_, err := newNotifier(testWebhookConfig(wc), realClock{})
+		assert.Error(t, err, wc)
+	}
+
+	n, err = newNotifier(testWebhookConfig(webhookConfig{URL: "https://hooks.example.com/token"}), realClock{})
+	require.NoError(t, err)
+	s := n.sinks[0]
+	assert.Equal(t, "hooks.example.com", s.name)
+	assert.Equal(t, defaultWebhookBatchSize, s.batchSize)
+	assert.Equal(t, time.Second, s.batchInterval)
+	assert.Equal(t, defaultWebhookMaxRetries, s.maxRetries)
+	assert.Equal(t, 5*time.Second, s.client.Timeout)
+
+	// Retries can be disabled
+	n, err = newNotifier(testWebhookConfig(webhookConfig{URL: "https://hooks.example.com/token", MaxRetries: &zero}), realClock{})
+	require.NoError(t, err)
+	assert.Equal(t, 0, n.sinks[0].maxRetries)
+}
+
+func TestWebhookBatches(t *testing.T) {
+	server := newTestWebhookServer(t)
+	n, err := newNotifier(testWebhookConfig(webhookConfig{
+		Name:            "batches-test",
+		URL:             server.URL,
+		Secret:          "secret",
+		BatchSize:       3,
+		BatchIntervalMs: 200,
+	}), realClock{})
+	require.NoError(t, err)
+	delivered := func() float64 {
+		return testutil.ToFloat64(webhookEvents.WithLabelValues("batches-test", "delivered"))
+	}
+	before := delivered()
+	n.Start()
+
+	// A full batch is sent right away
+	n.Notify(event{Type: eventCheckFailed, Check: "http", Error: "connection refused"})
+	n.Notify(event{Type: eventWithdraw, Reason: reasonHealthCheckFailed})
+	n.Notify(event{Type: eventPeerDown, Peer: "10.0.0.254"})
+	r := server.Request(t)
+	assert.Equal(t, []string{eventCheckFailed, eventWithdraw, eventPeerDown}, eventTypesOf(r.events))
+	assert.Equal(t, "sha256="+signWebhookBody([]byte("secret"), r.body), r.signature)
+	e := r.events[1]
+	assert.Equal(t, "ingress", e.Service)
+	assert.Equal(t, "10.88.2.1", e.VIP)
+	assert.Equal(t, "10.0.0.1", e.Node)
+	assert.Equal(t, reasonHealthCheckFailed, e.Reason)
+	assert.False(t, e.Time.IsZero())
+
+	// Otherwise after the batch interval
+	n.Notify(event{Type: eventAdvertise, Reason: reasonHealthy})
+	server.NoRequest(t)
+	r = server.Request(t)
+	assert.Equal(t, []string{eventAdvertise}, eventTypesOf(r.events))
+
+	n.Stop()
+	assert.Equal(t, 4.0, delivered()-before)
+}
+
+func TestWebhookStopFlushesEvents(t *testing.T) {
+	server := newTestWebhookServer(t)
+	n, err := newNotifier(testWebhookConfig(webhookConfig{
+		URL:             server.URL,
+		Events:          []string{eventWithdraw},
+		BatchIntervalMs: int(time.Hour / time.Millisecond),
+	}), realClock{})
+	require.NoError(t, err)
+	n.Start()
+
+	// Only the listed events are sent, without a signature
+	n.Notify(event{Type: eventAdvertise})
+	n.Notify(event{Type: eventWithdraw, Reason: reasonShutdown})
+	n.Stop()
+	r := server.Request(t)
+	assert.Equal(t, []string{eventWithdraw}, eventTypesOf(r.events))
+	assert.Empty(t, r.signature)
+	server.NoRequest(t)
+}
+
+func TestWebhookRetries(t *testing.T) {
+	batch := []event{{Type: eventWithdraw}}
+	newSink := func(t *testing.T, server *testWebhookServer) (*webhookSink, *fakeClock) {
+		clk := &fakeClock{now: time.Unix(0, 0)}
+		retries := 3
+		s, err := newWebhookSink(webhookConfig{URL: server.URL, MaxRetries: &retries}, clk)
+		require.NoError(t, err)
+		return s, clk
+	}
+
+	// Server errors are retried with backoff
+	server := newTestWebhookServer(t, http.StatusServiceUnavailable, http.StatusTooManyRequests)
+	s, clk := newSink(t, server)
+	require.NoError(t, s.send(context.Background(), batch, s.maxRetries))
+	assert.Len(t, server.requests, 3)
+	assert.Equal(t, time.Unix(3, 0), clk.Now())
+
+	// Up to the max retries
+	server = newTestWebhookServer(t, 500, 500, 500, 500, 500)
+	s, clk = newSink(t, server)
+	assert.Error(t, s.send(context.Background(), batch, s.maxRetries))
+	assert.Len(t, server.requests, 4)
+	assert.Equal(t, time.Unix(7, 0), clk.Now())
+
+	// Client errors are not retried
+	server = newTestWebhookServer(t, http.StatusBadRequest)
+	s, clk = newSink(t, server)
+	assert.Error(t, s.send(context.Background(), batch, s.maxRetries))
+	assert.Len(t, server.requests, 1)
+	assert.Equal(t, time.Unix(0, 0), clk.Now())
+}
+
+func TestWebhookStopCancelsRetries(t *testing.T) {
+	server := newTestWebhookServer(t, 500, 500, 500)
+	n, err := newNotifier(testWebhookConfig(webhookConfig{
+		URL:       server.URL,
+		BatchSize: 1,
+	}), realClock{})
+	require.NoError(t, err)
+	n.Start()
+
+	// The first delivery fails and waits a second to be retried
+	n.Notify(event{Type: eventAdvertise})
+	server.Request(t)
+	n.Notify(event{Type: eventWithdraw, Reason: reasonShutdown})
+
+	// Stopping interrupts the backoff and sends the pending events once
+	start := time.Now()
+	n.Stop()
+	assert.Less(t, time.Since(start), 500*time.Millisecond)
+	assert.Equal(t, []string{eventAdvertise}, eventTypesOf(server.Request(t).events))
+	assert.Equal(t, []string{eventWithdraw}, eventTypesOf(server.Request(t).events))
+	server.NoRequest(t)
+}